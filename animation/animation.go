@@ -0,0 +1,173 @@
+// Package animation decodes animated GIF and WebP icons into fully composited
+// frames, and encodes frames back into an animated GIF or WebP.
+package animation
+
+import (
+	"bytes"
+	"errors"
+	"faviconapi/iconpatch"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotAnimated is returned for WebP files without the animation flag.
+	ErrNotAnimated = errors.New("animation: not animated")
+	ErrTooLarge    = errors.New("animation: too many frames or pixels")
+	errInvalid     = errors.New("animation: invalid file")
+)
+
+const (
+	// MaxFrames is the number of frames decoded at most, the remaining ones are dropped.
+	MaxFrames = 256
+	// maxPixels bounds the memory used by the composited frames.
+	maxPixels = 64 << 20
+)
+
+// Frame is a frame composited over the ones before it, as it is displayed.
+type Frame struct {
+	Image *image.NRGBA
+	Delay time.Duration
+}
+
+type Animation struct {
+	Frames []Frame
+	// LoopCount is the number of times the animation repeats, 0 meaning forever.
+	LoopCount int
+}
+
+// Decode reads a GIF or an animated WebP file.
+func Decode(data []byte) (*Animation, error) {
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		return DecodeGIF(data)
+	}
+
+	return DecodeWebP(data)
+}
+
+func DecodeGIF(data []byte) (*Animation, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	canvasRect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, frame := range g.Image {
+		canvasRect = canvasRect.Union(frame.Bounds())
+	}
+
+	if len(g.Image) > MaxFrames {
+		g.Image = g.Image[:MaxFrames]
+	}
+
+	if canvasRect.Dx()*canvasRect.Dy()*len(g.Image) > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	anim := &Animation{LoopCount: max(g.LoopCount, 0)}
+	canvas := image.NewNRGBA(canvasRect)
+
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious {
+			previous = clone(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		var delay time.Duration
+		if i < len(g.Delay) {
+			delay = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+
+		anim.Frames = append(anim.Frames, Frame{Image: clone(canvas), Delay: delay})
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	if len(anim.Frames) == 0 {
+		return nil, errInvalid
+	}
+
+	return anim, nil
+}
+
+// Representative returns the index of the least transparent frame, which
+// is usually the one showing the whole logo.
+func (a *Animation) Representative() int {
+	best, bestOpacity := 0, -1
+	for i, frame := range a.Frames {
+		opacity := 0
+		for j := 3; j < len(frame.Image.Pix); j += 4 {
+			opacity += int(frame.Image.Pix[j])
+		}
+
+		if opacity > bestOpacity {
+			best, bestOpacity = i, opacity
+		}
+	}
+
+	return best
+}
+
+// EncodeGIF writes frames as an animated GIF, each with its own palette. GIF
+// transparency being binary, pixels less than half opaque become transparent.
+func EncodeGIF(w io.Writer, frames []Frame, loopCount int) error {
+	g := &gif.GIF{LoopCount: loopCount}
+
+	for _, frame := range frames {
+		bounds := frame.Image.Bounds()
+
+		palette := color.Palette{color.NRGBA{}}
+		for _, c := range iconpatch.ExtractPalette(frame.Image, 255) {
+			palette = append(palette, c)
+		}
+
+		// Sampling may have missed the few visible pixels of a frame.
+		if len(palette) == 1 {
+			palette = append(palette, color.NRGBA{A: 255})
+		}
+
+		paletted := image.NewPaletted(bounds, palette)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := frame.Image.NRGBAAt(x, y)
+				if c.A < 128 {
+					paletted.SetColorIndex(x, y, 0)
+					continue
+				}
+
+				c.A = 255
+				paletted.SetColorIndex(x, y, uint8(1+palette[1:].Index(c)))
+			}
+		}
+
+		g.Image = append(g.Image, paletted)
+		g.Delay = append(g.Delay, int(frame.Delay/(10*time.Millisecond)))
+		// Frames are complete images, the previous one must not show through.
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+
+	return gif.EncodeAll(w, g)
+}
+
+func clone(img *image.NRGBA) *image.NRGBA {
+	c := image.NewNRGBA(img.Bounds())
+	copy(c.Pix, img.Pix)
+
+	return c
+}
@@ -0,0 +1,348 @@
+package animation
+
+import (
+	"errors"
+	"image"
+	"sort"
+)
+
+// maxVP8LSide is the largest width or height a VP8L bitstream can describe.
+const maxVP8LSide = 1 << 14
+
+// bitWriter packs values least significant bit first, as VP8L reads them.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	bits uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.acc |= uint64(v) << w.bits
+	w.bits += n
+	for w.bits >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.bits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.bits > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc, w.bits = 0, 0
+	}
+
+	return w.buf
+}
+
+// prefixCode holds the code of every symbol of an alphabet, bit reversed so
+// that it can be written as is.
+type prefixCode struct {
+	codes   []uint32
+	lengths []uint8
+}
+
+func (c *prefixCode) write(w *bitWriter, symbol int) {
+	w.write(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for freq, no longer
+// than limit. Rare symbols are made more frequent until the code fits.
+func huffmanLengths(freq []int, limit int) []uint8 {
+	var used []int
+	for symbol, n := range freq {
+		if n > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	lengths := make([]uint8, len(freq))
+	if len(used) == 1 {
+		lengths[used[0]] = 1
+		return lengths
+	}
+
+	for floor := 1; ; floor *= 2 {
+		weight := func(symbol int) int { return max(freq[symbol], floor) }
+		sort.SliceStable(used, func(i, j int) bool { return weight(used[i]) < weight(used[j]) })
+
+		// Two queues: the leaves by weight, then the internal nodes in the
+		// order they are made, which is by weight too.
+		weights := make([]int, 0, 2*len(used))
+		for _, symbol := range used {
+			weights = append(weights, weight(symbol))
+		}
+
+		parent := make([]int, 2*len(used)-1)
+		leaf, node := 0, len(used)
+		smallest := func() int {
+			if leaf < len(used) && (node >= len(weights) || weights[leaf] <= weights[node]) {
+				leaf++
+				return leaf - 1
+			}
+
+			node++
+			return node - 1
+		}
+
+		for len(weights) < 2*len(used)-1 {
+			a, b := smallest(), smallest()
+			parent[a], parent[b] = len(weights), len(weights)
+			weights = append(weights, weights[a]+weights[b])
+		}
+
+		longest := 0
+		for i, symbol := range used {
+			depth := 0
+			for n := i; n != len(weights)-1; n = parent[n] {
+				depth++
+			}
+
+			lengths[symbol] = uint8(depth)
+			longest = max(longest, depth)
+		}
+
+		if longest <= limit {
+			return lengths
+		}
+	}
+}
+
+// canonicalCode assigns the canonical Huffman codes of lengths.
+func canonicalCode(lengths []uint8) *prefixCode {
+	var count [16]uint32
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+
+	var next [16]uint32
+	code := uint32(0)
+	for l := 1; l < len(next); l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	c := &prefixCode{codes: make([]uint32, len(lengths)), lengths: lengths}
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+
+		code := next[l]
+		next[l]++
+
+		var reversed uint32
+		for i := uint8(0); i < l; i++ {
+			reversed = reversed<<1 | (code>>i)&1
+		}
+		c.codes[symbol] = reversed
+	}
+
+	return c
+}
+
+// codeLengthOrder is the order the lengths of the code length code are written in.
+var codeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+type codeLengthToken struct {
+	symbol    int
+	extra     uint32
+	extraBits uint
+}
+
+// tokenizeLengths run-length encodes code lengths: 16 repeats the previous
+// length 3 to 6 times, 17 and 18 are runs of 3 to 10 and 11 to 138 zeros.
+func tokenizeLengths(lengths []uint8) []codeLengthToken {
+	var tokens []codeLengthToken
+
+	previous := uint8(8)
+	for i := 0; i < len(lengths); {
+		l := lengths[i]
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 3 {
+				if n := min(run, 138); n >= 11 {
+					tokens = append(tokens, codeLengthToken{18, uint32(n - 11), 7})
+					run -= n
+				} else {
+					n = min(run, 10)
+					tokens = append(tokens, codeLengthToken{17, uint32(n - 3), 3})
+					run -= n
+				}
+			}
+
+			for ; run > 0; run-- {
+				tokens = append(tokens, codeLengthToken{symbol: 0})
+			}
+
+			continue
+		}
+
+		if l != previous {
+			tokens = append(tokens, codeLengthToken{symbol: int(l)})
+			previous = l
+			run--
+		}
+
+		for run >= 3 {
+			n := min(run, 6)
+			tokens = append(tokens, codeLengthToken{16, uint32(n - 3), 2})
+			run -= n
+		}
+
+		for ; run > 0; run-- {
+			tokens = append(tokens, codeLengthToken{symbol: int(l)})
+		}
+	}
+
+	return tokens
+}
+
+// writePrefixCode writes the prefix code of a histogram and returns it.
+func writePrefixCode(w *bitWriter, freq []int) *prefixCode {
+	var used []int
+	for symbol, n := range freq {
+		if n > 0 {
+			used = append(used, symbol)
+		}
+	}
+
+	if len(used) == 0 {
+		used = []int{0}
+	}
+
+	// The simple form holds one or two symbols below 256, coded on 0 or 1 bit.
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		w.write(1, 1)
+		w.write(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+
+		c := &prefixCode{codes: make([]uint32, len(freq)), lengths: make([]uint8, len(freq))}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+			c.codes[used[1]] = 1
+			c.lengths[used[0]], c.lengths[used[1]] = 1, 1
+		}
+
+		return c
+	}
+
+	lengths := huffmanLengths(freq, 15)
+	tokens := tokenizeLengths(lengths)
+
+	tokenFreq := make([]int, len(codeLengthOrder))
+	for _, token := range tokens {
+		tokenFreq[token.symbol]++
+	}
+
+	// A code of a single symbol takes no bits to read, the length given to
+	// it here would be wrong: a second one is made up.
+	if len(tokens) > 0 && tokenFreq[tokens[0].symbol] == len(tokens) {
+		tokenFreq[(tokens[0].symbol+1)%len(tokenFreq)] = 1
+	}
+
+	tokenCode := canonicalCode(huffmanLengths(tokenFreq, 7))
+
+	count := len(codeLengthOrder)
+	for count > 4 && tokenCode.lengths[codeLengthOrder[count-1]] == 0 {
+		count--
+	}
+
+	w.write(0, 1)
+	w.write(uint32(count-4), 4)
+	for _, symbol := range codeLengthOrder[:count] {
+		w.write(uint32(tokenCode.lengths[symbol]), 3)
+	}
+
+	// Lengths are given for the whole alphabet, max_symbol is not used.
+	w.write(0, 1)
+	for _, token := range tokens {
+		tokenCode.write(w, token.symbol)
+		w.write(token.extra, token.extraBits)
+	}
+
+	return canonicalCode(lengths)
+}
+
+// encodeVP8L encodes img as a lossless WebP bitstream, the payload of a VP8L
+// chunk. Only the subtract green transform is used, and no backward
+// references: icons are small, the point is to keep them exact.
+func encodeVP8L(img *image.NRGBA) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width < 1 || height < 1 || width > maxVP8LSide || height > maxVP8LSide {
+		return nil, errors.New("animation: image size not supported by WebP")
+	}
+
+	// Green, red and blue minus green, and alpha of every pixel. The color of
+	// transparent pixels is dropped.
+	pixels := make([][4]uint8, 0, width*height)
+	opaque := true
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			r, g, b, a := img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]
+			if a == 0 {
+				r, g, b = 0, 0, 0
+			}
+
+			opaque = opaque && a == 255
+			pixels = append(pixels, [4]uint8{g, r - g, b - g, a})
+		}
+	}
+
+	w := &bitWriter{}
+	w.write(0x2f, 8)
+	w.write(uint32(width-1), 14)
+	w.write(uint32(height-1), 14)
+	if opaque {
+		w.write(0, 1)
+	} else {
+		w.write(1, 1)
+	}
+	w.write(0, 3)
+
+	const subtractGreen = 2
+	w.write(1, 1)
+	w.write(subtractGreen, 2)
+	w.write(0, 1)
+
+	// No color cache, and one group of prefix codes for the whole image.
+	w.write(0, 1)
+	w.write(0, 1)
+
+	// Green, red, blue and alpha histograms. The green alphabet also holds the
+	// length prefixes of backward references, never used here.
+	histograms := [4][]int{make([]int, 256+24), make([]int, 256), make([]int, 256), make([]int, 256)}
+	for _, p := range pixels {
+		for i, v := range p {
+			histograms[i][v]++
+		}
+	}
+
+	var codes [4]*prefixCode
+	for i, histogram := range histograms {
+		codes[i] = writePrefixCode(w, histogram)
+	}
+	writePrefixCode(w, make([]int, 40))
+
+	for _, p := range pixels {
+		for i, v := range p {
+			codes[i].write(w, int(v))
+		}
+	}
+
+	return w.bytes(), nil
+}
@@ -0,0 +1,243 @@
+package animation
+
+import (
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/image/webp"
+	"image"
+	"image/draw"
+	"io"
+	"time"
+)
+
+type chunk struct {
+	id   string
+	data []byte
+}
+
+// readChunks splits a RIFF payload in chunks.
+func readChunks(data []byte) ([]chunk, error) {
+	var chunks []chunk
+
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size < 0 || 8+size > len(data) {
+			return nil, errInvalid
+		}
+
+		chunks = append(chunks, chunk{id: string(data[:4]), data: data[8 : 8+size]})
+
+		// Chunks are padded to an even size.
+		next := 8 + size + size&1
+		if next > len(data) {
+			break
+		}
+
+		data = data[next:]
+	}
+
+	return chunks, nil
+}
+
+func writeChunk(buf *bytes.Buffer, id string, data []byte) {
+	buf.WriteString(id)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+	buf.Write(data)
+	if len(data)&1 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// DecodeWebP reads an animated WebP file. golang.org/x/image/webp only knows
+// about still images, so each ANMF frame is rewrapped as a standalone file.
+func DecodeWebP(data []byte) (*Animation, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errInvalid
+	}
+
+	chunks, err := readChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chunks) == 0 || chunks[0].id != "VP8X" || len(chunks[0].data) < 10 {
+		return nil, ErrNotAnimated
+	}
+
+	const animationBit = 1 << 1
+	header := chunks[0].data
+	if header[0]&animationBit == 0 {
+		return nil, ErrNotAnimated
+	}
+
+	canvasRect := image.Rect(0, 0, uint24(header[4:7])+1, uint24(header[7:10])+1)
+
+	anim := &Animation{}
+	var frameChunks []chunk
+	for _, c := range chunks[1:] {
+		switch c.id {
+		case "ANIM":
+			if len(c.data) >= 6 {
+				anim.LoopCount = int(binary.LittleEndian.Uint16(c.data[4:6]))
+			}
+		case "ANMF":
+			frameChunks = append(frameChunks, c)
+		}
+	}
+
+	if len(frameChunks) > MaxFrames {
+		frameChunks = frameChunks[:MaxFrames]
+	}
+
+	if len(frameChunks) == 0 {
+		return nil, errInvalid
+	}
+
+	if canvasRect.Dx()*canvasRect.Dy()*len(frameChunks) > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	canvas := image.NewNRGBA(canvasRect)
+	for _, c := range frameChunks {
+		if len(c.data) < 16 {
+			return nil, errInvalid
+		}
+
+		x, y := uint24(c.data[0:3])*2, uint24(c.data[3:6])*2
+		w, h := uint24(c.data[6:9])+1, uint24(c.data[9:12])+1
+		duration := uint24(c.data[12:15])
+		flags := c.data[15]
+
+		frame, err := decodeFrame(c.data[16:], w, h)
+		if err != nil {
+			return nil, err
+		}
+
+		rect := image.Rect(x, y, x+w, y+h)
+
+		op := draw.Over
+		if flags&0x02 != 0 { // do not blend
+			op = draw.Src
+		}
+		draw.Draw(canvas, rect, frame, frame.Bounds().Min, op)
+
+		anim.Frames = append(anim.Frames, Frame{
+			Image: clone(canvas),
+			Delay: time.Duration(duration) * time.Millisecond,
+		})
+
+		if flags&0x01 != 0 { // dispose to background
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+
+	return anim, nil
+}
+
+// decodeFrame decodes the chunks of an ANMF frame, an optional ALPH chunk
+// followed by a VP8 or VP8L one.
+func decodeFrame(data []byte, w, h int) (image.Image, error) {
+	chunks, err := readChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var alpha, bitstream *chunk
+	for i := range chunks {
+		switch chunks[i].id {
+		case "ALPH":
+			alpha = &chunks[i]
+		case "VP8 ", "VP8L":
+			bitstream = &chunks[i]
+		}
+	}
+
+	if bitstream == nil {
+		return nil, errInvalid
+	}
+
+	body := new(bytes.Buffer)
+	body.WriteString("WEBP")
+
+	if alpha != nil && bitstream.id == "VP8 " {
+		const alphaBit = 1 << 4
+
+		vp8x := make([]byte, 10)
+		vp8x[0] = alphaBit
+		putUint24(vp8x[4:7], w-1)
+		putUint24(vp8x[7:10], h-1)
+
+		writeChunk(body, "VP8X", vp8x)
+		writeChunk(body, alpha.id, alpha.data)
+	}
+
+	writeChunk(body, bitstream.id, bitstream.data)
+
+	file := new(bytes.Buffer)
+	writeChunk(file, "RIFF", body.Bytes())
+
+	return webp.Decode(file)
+}
+
+// EncodeWebP writes frames as a lossless animated WebP. Frames are complete
+// images of the size of the first one, each replaces the one before it.
+func EncodeWebP(w io.Writer, frames []Frame, loopCount int) error {
+	if len(frames) == 0 {
+		return errInvalid
+	}
+
+	size := frames[0].Image.Bounds().Size()
+
+	body := new(bytes.Buffer)
+	body.WriteString("WEBP")
+
+	const animationBit, alphaBit = 1 << 1, 1 << 4
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = animationBit | alphaBit
+	putUint24(vp8x[4:7], size.X-1)
+	putUint24(vp8x[7:10], size.Y-1)
+	writeChunk(body, "VP8X", vp8x)
+
+	// A transparent background, then the loop count.
+	anim := make([]byte, 6)
+	binary.LittleEndian.PutUint16(anim[4:6], uint16(min(loopCount, 0xffff)))
+	writeChunk(body, "ANIM", anim)
+
+	for _, frame := range frames {
+		if frame.Image.Bounds().Size() != size {
+			return errInvalid
+		}
+
+		bitstream, err := encodeVP8L(frame.Image)
+		if err != nil {
+			return err
+		}
+
+		anmf := new(bytes.Buffer)
+
+		header := make([]byte, 16)
+		putUint24(header[6:9], size.X-1)
+		putUint24(header[9:12], size.Y-1)
+		putUint24(header[12:15], min(int(frame.Delay/time.Millisecond), 1<<24-1))
+		header[15] = 0x02 // do not blend
+		anmf.Write(header)
+
+		writeChunk(anmf, "VP8L", bitstream)
+		writeChunk(body, "ANMF", anmf.Bytes())
+	}
+
+	file := new(bytes.Buffer)
+	writeChunk(file, "RIFF", body.Bytes())
+
+	_, err := w.Write(file.Bytes())
+	return err
+}
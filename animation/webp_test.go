@@ -0,0 +1,84 @@
+package animation
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func randomFrame(r *rand.Rand, w, h int, colors int) *image.NRGBA {
+	palette := make([]color.NRGBA, colors)
+	for i := range palette {
+		palette[i] = color.NRGBA{R: uint8(r.Intn(256)), G: uint8(r.Intn(256)), B: uint8(r.Intn(256)), A: uint8(r.Intn(256))}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, palette[r.Intn(colors)])
+		}
+	}
+
+	return img
+}
+
+// EncodeWebP is lossless, decoding its output gives the frames back except
+// for the color of transparent pixels.
+func TestEncodeWebP(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	// One, two and many colors go through the different prefix code forms.
+	for _, colors := range []int{1, 2, 3, 300} {
+		frames := []Frame{
+			{Image: randomFrame(r, 37, 21, colors), Delay: 100 * time.Millisecond},
+			{Image: randomFrame(r, 37, 21, colors), Delay: 250 * time.Millisecond},
+		}
+
+		buf := new(bytes.Buffer)
+		if err := EncodeWebP(buf, frames, 3); err != nil {
+			t.Fatal(err)
+		}
+
+		anim, err := DecodeWebP(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%d colors: DecodeWebP: %v", colors, err)
+		}
+
+		if len(anim.Frames) != len(frames) || anim.LoopCount != 3 {
+			t.Fatalf("%d colors: got %d frames looping %d times", colors, len(anim.Frames), anim.LoopCount)
+		}
+
+		for i, frame := range frames {
+			if anim.Frames[i].Delay != frame.Delay {
+				t.Errorf("%d colors, frame %d: delay %v, want %v", colors, i, anim.Frames[i].Delay, frame.Delay)
+			}
+
+			for j := 0; j < len(frame.Image.Pix); j += 4 {
+				want, got := frame.Image.Pix[j:j+4], anim.Frames[i].Image.Pix[j:j+4]
+				if want[3] == 0 && got[3] == 0 {
+					continue
+				}
+
+				if !bytes.Equal(want, got) {
+					t.Fatalf("%d colors, frame %d: pixel %d is %v, want %v", colors, i, j/4, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestHuffmanLengthsLimit(t *testing.T) {
+	freq := make([]int, 19)
+	for i := range freq {
+		freq[i] = 1 << i
+	}
+
+	for symbol, l := range huffmanLengths(freq, 7) {
+		if l == 0 || l > 7 {
+			t.Errorf("symbol %d has length %d", symbol, l)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	_ "embed"
+	"faviconapi/defaults"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IconResponseV2 is the body of every /api/v2/icons response. Exactly one of
+// Icon and Error is set, FallbackURL may come with Error when the site has no icon.
+type IconResponseV2 struct {
+	Icon        *IconV2  `json:"icon,omitempty"`
+	FallbackURL string   `json:"fallbackUrl,omitempty"`
+	Error       *ErrorV2 `json:"error,omitempty"`
+	RequestID   string   `json:"requestId"`
+}
+
+type ErrorV2 struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+type IconV2 struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Format is png, gif or webp.
+	Format string `json:"format"`
+	// SourceURL is where the icon was downloaded from, empty for generated ones.
+	SourceURL string    `json:"sourceUrl,omitempty"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	Transform string    `json:"transform,omitempty"`
+	Flags     IconFlags `json:"flags"`
+	// Adjustment is what was done to the icon to fit a dark background.
+	Adjustment string      `json:"adjustment,omitempty"`
+	Colors     *IconColors `json:"colors,omitempty"`
+	SHA256     string      `json:"sha256,omitempty"`
+	PHash      string      `json:"phash,omitempty"`
+	Version    string      `json:"version"`
+}
+
+type IconFlags struct {
+	Filled    bool `json:"filled"`
+	Animated  bool `json:"animated"`
+	Generated bool `json:"generated"`
+	Dark      bool `json:"dark"`
+}
+
+type IconColors struct {
+	Dominant  string   `json:"dominant"`
+	Palette   []string `json:"palette"`
+	Luminance float64  `json:"luminance"`
+}
+
+// iconV2 reads the metadata stored along with an icon.
+func iconV2(URL string, meta map[string]string) *IconV2 {
+	icon := &IconV2{
+		URL:        URL,
+		Format:     meta["format"],
+		SourceURL:  meta["source"],
+		Transform:  meta["transform"],
+		Adjustment: meta["adjustment"],
+		SHA256:     meta["sha256"],
+		PHash:      meta["phash"],
+		Version:    meta["version"],
+		Flags: IconFlags{
+			Filled:    meta["filled"] == "yes",
+			Animated:  meta["animated"] == "yes",
+			Generated: meta["generated"] == "yes",
+			Dark:      meta["theme"] == "dark",
+		},
+	}
+
+	icon.Width, _ = strconv.Atoi(meta["width"])
+	icon.Height, _ = strconv.Atoi(meta["height"])
+	icon.FetchedAt, _ = time.Parse(time.RFC3339, meta["fetchedat"])
+
+	if meta["dominant"] != "" {
+		icon.Colors = &IconColors{Dominant: meta["dominant"], Palette: []string{}}
+		if meta["palette"] != "" {
+			icon.Colors.Palette = strings.Split(meta["palette"], ",")
+		}
+		icon.Colors.Luminance, _ = strconv.ParseFloat(meta["luminance"], 64)
+	}
+
+	return icon
+}
+
+// errorV2 moves the error of res into a v2 body.
+func errorV2(ctx Context, res HttpResponse, fallbackURL string) HttpResponse {
+	message, _ := res.Value.(string)
+	res.Body = IconResponseV2{
+		FallbackURL: fallbackURL,
+		Error:       &ErrorV2{Code: res.Error, Message: message},
+		RequestID:   ctx.requestID,
+	}
+
+	return res
+}
+
+// GetIconEndpointV2 takes the same parameters as GetFaviconEndpoint. A site
+// without icon is a 404 with the icon_not_found code, along with fallbackUrl.
+func GetIconEndpointV2(ctx Context, rw http.ResponseWriter, r *http.Request) HttpResponse {
+	req, err := parseResolveRequest(r, "/api/v2/icons")
+	if err != nil {
+		return errorV2(ctx, errorResponse(ctx, err), "")
+	}
+
+	fallbackURL := strings.TrimSpace(r.URL.Query().Get("fallbackURL"))
+
+	res, err := resolveIcon(ctx, req)
+	if err != nil {
+		return errorV2(ctx, errorResponse(ctx, err), fallbackURL)
+	}
+
+	if defaults.CacheStatus == defaults.CacheEnabled {
+		rw.Header().Add("Cache-Control", "max-age=604800, immutable") // one week
+	}
+
+	return HttpResponse{
+		Success: true,
+		Status:  http.StatusOK,
+		Body:    IconResponseV2{Icon: iconV2(res.URL, res.Meta), RequestID: ctx.requestID},
+	}
+}
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+func GetOpenAPIEndpoint(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(openAPIDocument)
+}
@@ -0,0 +1,166 @@
+// Package avatar renders letter avatars, colored tiles showing the initials of
+// a site, used in place of icons that cannot be found.
+package avatar
+
+import (
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Size is the width and height of generated avatars.
+const Size = 128
+
+var (
+	fontOnce sync.Once
+	goBold   *opentype.Font
+	fontErr  error
+)
+
+func loadFont() (*opentype.Font, error) {
+	fontOnce.Do(func() {
+		goBold, fontErr = opentype.Parse(gobold.TTF)
+	})
+
+	return goBold, fontErr
+}
+
+// Initials returns the letters shown for host: the first letter of the
+// registrable domain name, and of its second word when it has dashes.
+func Initials(host string) string {
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(name) != nil {
+		return "#"
+	}
+
+	if site, err := publicsuffix.EffectiveTLDPlusOne(name); err == nil {
+		suffix, _ := publicsuffix.PublicSuffix(site)
+		name = strings.TrimSuffix(site, "."+suffix)
+	} else {
+		name = strings.TrimPrefix(name, "www.")
+	}
+
+	if unicodeName, err := idna.ToUnicode(name); err == nil {
+		name = unicodeName
+	}
+
+	var initials []rune
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == '-' || r == '.' }) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				initials = append(initials, unicode.ToUpper(r))
+				break
+			}
+		}
+
+		if len(initials) == 2 {
+			break
+		}
+	}
+
+	if len(initials) == 0 {
+		return "#"
+	}
+
+	return string(initials)
+}
+
+// Color derives the tile color from host. Hues vary, saturation and lightness
+// are fixed so that white letters always read well.
+func Color(host string) color.NRGBA {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.ToLower(host)))
+
+	return hsl(float64(h.Sum32()%360), 0.55, 0.42)
+}
+
+func hsl(h, s, l float64) color.NRGBA {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return color.NRGBA{
+		R: uint8(math.Round((r + m) * 255)),
+		G: uint8(math.Round((g + m) * 255)),
+		B: uint8(math.Round((b + m) * 255)),
+		A: 255,
+	}
+}
+
+// Generate renders the avatar of host, returning the initials it shows and
+// the tile color along with the image.
+func Generate(host string) (*image.NRGBA, string, color.NRGBA, error) {
+	initials := Initials(host)
+	bg := Color(host)
+
+	img := image.NewNRGBA(image.Rect(0, 0, Size, Size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+	f, err := loadFont()
+	if err != nil {
+		return nil, "", bg, err
+	}
+
+	// Letters the font does not have are drawn as boxes, better show something generic.
+	buf := &sfnt.Buffer{}
+	for _, r := range initials {
+		if index, err := f.GlyphIndex(buf, r); err != nil || index == 0 {
+			initials = "#"
+			break
+		}
+	}
+
+	size := 0.5 * Size
+	if len([]rune(initials)) > 1 {
+		size = 0.4 * Size
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, "", bg, err
+	}
+	defer face.Close()
+
+	drawer := &font.Drawer{Dst: img, Src: image.White, Face: face}
+
+	// Center the ink of the letters, not their advance box.
+	bounds, _ := drawer.BoundString(initials)
+	width := bounds.Max.X - bounds.Min.X
+	height := bounds.Max.Y - bounds.Min.Y
+	drawer.Dot = fixed.Point26_6{
+		X: (fixed.I(Size)-width)/2 - bounds.Min.X,
+		Y: (fixed.I(Size)-height)/2 - bounds.Min.Y,
+	}
+	drawer.DrawString(initials)
+
+	return img, initials, bg, nil
+}
@@ -0,0 +1,529 @@
+// Command iconsnatch runs the icon pipeline of the API offline: it converts
+// local icon files, resolves the icon of sites from this machine and describes
+// icon files.
+//
+//	iconsnatch convert [-o out.png] [-transform edgekey] [-size 64] [-format png] [file ...]
+//	iconsnatch resolve [-o dir] [-transform edgekey] example.com [...]
+//	iconsnatch inspect [file ...]
+//
+// Every command takes several inputs, or a list of them with -list, in which
+// case -o names a directory. Reading from stdin is done with "-" or no input.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"faviconapi/animation"
+	"faviconapi/favicon"
+	"faviconapi/ico"
+	"faviconapi/iconpatch"
+	"flag"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: iconsnatch <command> [flags] [input ...]
+
+commands:
+  convert  run icon files through a transform pipeline
+  resolve  find, download and convert the icon of sites
+  inspect  describe icon files
+
+Run iconsnatch <command> -h for the flags of a command.
+`
+
+func main() {
+	err := run(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("missing command")
+	}
+
+	switch args[0] {
+	case "convert":
+		return runConvert(args[1:])
+	case "resolve":
+		return runResolve(args[1:])
+	case "inspect":
+		return runInspect(args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// outputOptions are the flags shared by the commands producing icons.
+type outputOptions struct {
+	output    string
+	format    string
+	size      int
+	pipeline  iconpatch.Pipeline
+	animation favicon.AnimationPolicy
+}
+
+func (o *outputOptions) register(fs *flag.FlagSet) (transform, anim *string) {
+	fs.StringVar(&o.output, "o", "", "output file, - for stdout, or directory when there are several inputs")
+	fs.StringVar(&o.format, "format", "", "png, gif or webp, defaults to the format of preserved animations and png otherwise")
+	fs.IntVar(&o.size, "size", 0, "scale the icon to fit in a square of this many pixels, 0 keeps its size")
+
+	transform = fs.String("transform", "", "transform pipeline, such as edgekey,trim,square:padding=10")
+	anim = fs.String("animation", string(favicon.AnimationFirst), "first, representative or preserve")
+
+	return transform, anim
+}
+
+func (o *outputOptions) parse(transform, anim string) error {
+	var err error
+
+	o.pipeline, err = iconpatch.ParsePipeline(transform)
+	if err != nil {
+		return err
+	}
+
+	o.animation, err = favicon.ParseAnimationPolicy(anim)
+	if err != nil {
+		return err
+	}
+
+	switch o.format {
+	case "", "png", "gif", "webp":
+	default:
+		return fmt.Errorf("format must be png, gif or webp, not %q", o.format)
+	}
+
+	if o.size < 0 {
+		return errors.New("size must be positive")
+	}
+
+	return nil
+}
+
+// encode runs the icon through the pipeline and returns the resulting file
+// along with its extension.
+func (o *outputOptions) encode(icon *favicon.ResolvedIcon) ([]byte, string, error) {
+	patched, err := favicon.PatchIcon(icon, o.pipeline, o.animation)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if o.size > 0 {
+		patched = patched.Map(func(img image.Image) *image.NRGBA {
+			return fit(img, o.size)
+		})
+	}
+
+	format := o.format
+	if format == "" {
+		format = patched.Format()
+	}
+
+	switch {
+	case format == "png" && patched.Frames != nil:
+		return nil, "", errors.New("png cannot hold an animation, use -format gif or webp")
+	case format == "png" || format == patched.Format():
+		data, _, err := patched.Encode()
+		return data, format, err
+	}
+
+	frames := patched.Frames
+	if frames == nil {
+		frames = []animation.Frame{{Image: fit(patched.Image, 0)}}
+	}
+
+	buf := new(bytes.Buffer)
+	if format == "gif" {
+		err = animation.EncodeGIF(buf, frames, patched.LoopCount)
+	} else {
+		err = animation.EncodeWebP(buf, frames, patched.LoopCount)
+	}
+
+	return buf.Bytes(), format, err
+}
+
+// fit scales img to fit in a size×size square, keeping its aspect ratio. A
+// size of 0 keeps the image as is.
+func fit(img image.Image, size int) *image.NRGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	if size > 0 && w > 0 && h > 0 {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if dst.Bounds().Size() == bounds.Size() {
+		draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	}
+
+	return dst
+}
+
+// batch calls f for every input, reporting failures on stderr without
+// stopping at the first one.
+func batch(inputs []string, f func(input string) error) error {
+	failed := 0
+	for _, input := range inputs {
+		err := f(input)
+		if err != nil {
+			if len(inputs) == 1 {
+				return err
+			}
+
+			fmt.Fprintf(os.Stderr, "%s: %s\n", input, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d inputs failed", failed, len(inputs))
+	}
+
+	return nil
+}
+
+// inputs returns the arguments left after the flags, followed by the lines
+// of the list file if any.
+func inputs(fs *flag.FlagSet, list string) ([]string, error) {
+	inputs := fs.Args()
+
+	if list != "" {
+		var r io.Reader = os.Stdin
+		if list != "-" {
+			f, err := os.Open(list)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+
+			r = f
+		}
+
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			inputs = append(inputs, line)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return inputs, nil
+}
+
+func readInput(input string) ([]byte, error) {
+	if input == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+
+	return os.ReadFile(input)
+}
+
+// outputPath decides where the icon made from input goes. name is used for
+// files written into a directory, without its extension.
+func outputPath(output, name, ext string, several bool) (string, error) {
+	if !several {
+		return output, nil
+	}
+
+	if output == "-" {
+		return "", errors.New("cannot write several icons to stdout")
+	}
+
+	dir := output
+	if dir == "" {
+		dir = "."
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, name+"."+ext), nil
+}
+
+func writeOutput(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
+
+func newResolver() (*favicon.Resolver, error) {
+	opts, err := favicon.OptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	return favicon.NewResolver(opts)
+}
+
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ContinueOnError)
+	var opts outputOptions
+	transform, anim := opts.register(fs)
+	list := fs.String("list", "", "file listing the inputs, one per line, - for stdin")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := opts.parse(*transform, *anim); err != nil {
+		return err
+	}
+
+	files, err := inputs(fs, *list)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	resolver, err := newResolver()
+	if err != nil {
+		return err
+	}
+
+	several := len(files) > 1
+	if !several && opts.output == "" {
+		opts.output = "-"
+	}
+
+	return batch(files, func(file string) error {
+		data, err := readInput(file)
+		if err != nil {
+			return err
+		}
+
+		icon, err := resolver.LoadIcon(context.Background(), file, "", data)
+		if err != nil {
+			return err
+		}
+
+		out, ext, err := opts.encode(icon)
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		path, err := outputPath(opts.output, name, ext, several)
+		if err != nil {
+			return err
+		}
+
+		return writeOutput(path, out)
+	})
+}
+
+func runResolve(args []string) error {
+	fs := flag.NewFlagSet("resolve", flag.ContinueOnError)
+	var opts outputOptions
+	transform, anim := opts.register(fs)
+	list := fs.String("list", "", "file listing the sites, one per line, - for stdin")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := opts.parse(*transform, *anim); err != nil {
+		return err
+	}
+
+	sites, err := inputs(fs, *list)
+	if err != nil {
+		return err
+	}
+
+	if len(sites) == 0 {
+		return errors.New("usage: iconsnatch resolve [flags] <url> [...]")
+	}
+
+	resolver, err := newResolver()
+	if err != nil {
+		return err
+	}
+
+	// Icons are named after their site unless a single one goes to -o.
+	several := len(sites) > 1 || opts.output == ""
+
+	return batch(sites, func(site string) error {
+		target, err := parseSite(site)
+		if err != nil {
+			return err
+		}
+
+		icon, err := resolver.FindFaviconURL(context.Background(), target)
+		if err != nil {
+			return err
+		}
+
+		out, ext, err := opts.encode(icon)
+		if err != nil {
+			return err
+		}
+
+		path, err := outputPath(opts.output, target.Hostname(), ext, several)
+		if err != nil {
+			return err
+		}
+
+		if path != "-" {
+			fmt.Fprintf(os.Stderr, "%s: %s -> %s\n", site, icon.URL, path)
+		}
+
+		return writeOutput(path, out)
+	})
+}
+
+// parseSite accepts a bare host name as well as a full URL.
+func parseSite(site string) (*url.URL, error) {
+	if !strings.Contains(site, "://") {
+		site = "https://" + site
+	}
+
+	target, err := url.Parse(site)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" || target.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", site)
+	}
+
+	return target, nil
+}
+
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	list := fs.String("list", "", "file listing the inputs, one per line, - for stdin")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	files, err := inputs(fs, *list)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	// Placeholder icons are described like any other, their hash is what
+	// goes in a blocklist.
+	opts, err := favicon.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	opts.SkipBlocklist = true
+
+	resolver, err := favicon.NewResolver(opts)
+	if err != nil {
+		return err
+	}
+
+	return batch(files, func(file string) error {
+		data, err := readInput(file)
+		if err != nil {
+			return err
+		}
+
+		return inspect(os.Stdout, resolver, file, data)
+	})
+}
+
+// inspect describes an icon file. What is known from its bytes alone comes
+// first, so that files which cannot be decoded, such as SVG and AVIF ones, are
+// described too.
+func inspect(w io.Writer, resolver *favicon.Resolver, file string, data []byte) error {
+	sum := sha256.Sum256(data)
+	iconType := favicon.SniffType(data)
+
+	fmt.Fprintf(w, "%s\n", file)
+	fmt.Fprintf(w, "  size:       %d bytes\n", len(data))
+	fmt.Fprintf(w, "  sha256:     %s\n", hex.EncodeToString(sum[:]))
+	fmt.Fprintf(w, "  type:       %s\n", iconType)
+
+	if iconType != 0 && !iconType.Decodable() {
+		return nil
+	}
+
+	icon, err := resolver.LoadIcon(context.Background(), file, "", data)
+	if err != nil {
+		return err
+	}
+
+	bounds := icon.Image.Bounds()
+	fmt.Fprintf(w, "  dimensions: %dx%d\n", bounds.Dx(), bounds.Dy())
+
+	if icon.ColorProfile != "" {
+		fmt.Fprintf(w, "  profile:    %s\n", icon.ColorProfile)
+	}
+
+	if icon.Type == favicon.Ico || icon.Type == favicon.Cur {
+		frames, err := ico.Frames(data)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "  frames:     %d\n", len(frames))
+		for i, frame := range frames {
+			encoding := "bmp"
+			if frame.PNG {
+				encoding = "png"
+			}
+
+			fmt.Fprintf(w, "    %2d: %dx%d %d bpp %s, %d bytes\n", i, frame.Width, frame.Height, frame.BitsPerPixel, encoding, frame.Size)
+		}
+	}
+
+	if icon.Animation != nil {
+		fmt.Fprintf(w, "  frames:     %d, loop count %d\n", len(icon.Animation.Frames), icon.Animation.LoopCount)
+	}
+
+	fmt.Fprintf(w, "  filled:     %.1f%%\n", iconpatch.FilledPercent(icon.Image))
+	fmt.Fprintf(w, "  phash:      %s\n", icon.PHash)
+
+	return nil
+}
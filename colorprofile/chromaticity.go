@@ -0,0 +1,68 @@
+package colorprofile
+
+// d50 is the white point of the ICC profile connection space.
+var d50 = [3]float64{0.9642, 1, 0.8249}
+
+var bradford = matrix{
+	{0.8951, 0.2664, -0.1614},
+	{-0.7502, 1.7135, 0.0367},
+	{0.0389, -0.0685, 1.0296},
+}
+
+var bradfordInverse, _ = bradford.inverse()
+
+func xyToXYZ(x, y float64) [3]float64 {
+	return [3]float64{x / y, 1, (1 - x - y) / y}
+}
+
+func (m matrix) apply(v [3]float64) [3]float64 {
+	var r [3]float64
+	for i := 0; i < 3; i++ {
+		r[i] = m[i][0]*v[0] + m[i][1]*v[1] + m[i][2]*v[2]
+	}
+
+	return r
+}
+
+// chromaticityMatrix builds the matrix converting linear RGB to XYZ (D50) from
+// the white point and primaries of a cHRM chunk: white x, y, then red, green
+// and blue x, y.
+func chromaticityMatrix(xy [8]float64) (matrix, bool) {
+	for i := 1; i < len(xy); i += 2 {
+		if xy[i] <= 0 {
+			return matrix{}, false
+		}
+	}
+
+	white := xyToXYZ(xy[0], xy[1])
+	var primaries matrix
+	for i := 0; i < 3; i++ {
+		p := xyToXYZ(xy[2+2*i], xy[3+2*i])
+		for row := 0; row < 3; row++ {
+			primaries[row][i] = p[row]
+		}
+	}
+
+	inverse, ok := primaries.inverse()
+	if !ok {
+		return matrix{}, false
+	}
+
+	// Scale each primary so that they add up to the white point.
+	scale := inverse.apply(white)
+	var toXYZ matrix
+	for row := 0; row < 3; row++ {
+		for i := 0; i < 3; i++ {
+			toXYZ[row][i] = primaries[row][i] * scale[i]
+		}
+	}
+
+	// Bradford chromatic adaptation from the white point to D50.
+	src, dst := bradford.apply(white), bradford.apply(d50)
+	gain := matrix{{dst[0] / src[0], 0, 0}, {0, dst[1] / src[1], 0}, {0, 0, dst[2] / src[2]}}
+	adapt := bradfordInverse.mul(gain).mul(bradford)
+
+	m := adapt.mul(toXYZ)
+
+	return m, m.finite()
+}
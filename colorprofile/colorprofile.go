@@ -0,0 +1,236 @@
+// Package colorprofile reads the color profiles embedded in PNG, JPEG and
+// WebP files, and converts images using matrix/TRC based profiles to sRGB.
+package colorprofile
+
+import (
+	"errors"
+	"faviconapi/iconpatch"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+var ErrUnsupported = errors.New("colorprofile: unsupported profile")
+
+type matrix [3][3]float64
+
+func (m matrix) mul(n matrix) matrix {
+	var r matrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				r[i][j] += m[i][k] * n[k][j]
+			}
+		}
+	}
+
+	return r
+}
+
+func (m matrix) det() float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
+// inverse returns false for singular matrices, and for those whose inverse
+// is not finite.
+func (m matrix) inverse() (matrix, bool) {
+	a, b, c := m[0][0], m[0][1], m[0][2]
+	d, e, f := m[1][0], m[1][1], m[1][2]
+	g, h, i := m[2][0], m[2][1], m[2][2]
+
+	det := m.det()
+	if det == 0 || !isFinite(det) {
+		return matrix{}, false
+	}
+
+	inv := matrix{
+		{(e*i - f*h) / det, (c*h - b*i) / det, (b*f - c*e) / det},
+		{(f*g - d*i) / det, (a*i - c*g) / det, (c*d - a*f) / det},
+		{(d*h - e*g) / det, (b*g - a*h) / det, (a*e - b*d) / det},
+	}
+
+	return inv, inv.finite()
+}
+
+func (m matrix) finite() bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if !isFinite(m[i][j]) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// close is false as soon as an element differs by more than tolerance, or is NaN.
+func (m matrix) close(n matrix, tolerance float64) bool {
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			if !(math.Abs(m[i][j]-n[i][j]) <= tolerance) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func isFinite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// srgbToXYZ converts linear sRGB to XYZ relative to D50, the profile
+// connection space of ICC profiles.
+var srgbToXYZ = matrix{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+var xyzToSRGB, _ = srgbToXYZ.inverse()
+
+// curve maps an encoded component, from 0 to 1, to its linear value.
+type curve func(float64) float64
+
+func gammaCurve(gamma float64) curve {
+	return func(v float64) float64 {
+		return math.Pow(v, gamma)
+	}
+}
+
+func srgbCurve(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func srgbEncode(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// Profile describes how the components of an image relate to actual colors.
+type Profile struct {
+	// Name is the description of the profile, or what it was derived from.
+	Name string
+
+	toXYZ matrix
+	trc   [3]curve
+	// srgb is set when converting would not change anything noticeable.
+	srgb bool
+}
+
+// IsSRGB reports whether images using p can be used as is.
+func (p *Profile) IsSRGB() bool {
+	return p == nil || p.srgb
+}
+
+// finish rejects profiles that would not give finite colors, then flags the
+// ones matching sRGB.
+func (p *Profile) finish() error {
+	if !p.toXYZ.finite() {
+		return fmt.Errorf("%w: matrix is not finite", ErrUnsupported)
+	}
+
+	for _, trc := range p.trc {
+		for v := 0; v < 256; v++ {
+			if !isFinite(trc(float64(v) / 255)) {
+				return fmt.Errorf("%w: curve is not finite", ErrUnsupported)
+			}
+		}
+	}
+
+	p.detectSRGB()
+
+	return nil
+}
+
+// detectSRGB flags profiles whose primaries and curves match sRGB closely enough.
+func (p *Profile) detectSRGB() {
+	if !p.toXYZ.close(srgbToXYZ, 0.002) {
+		return
+	}
+
+	for _, trc := range p.trc {
+		for v := 0.0; v <= 1; v += 1.0 / 32 {
+			if !(math.Abs(trc(v)-srgbCurve(v)) <= 0.01) {
+				return
+			}
+		}
+	}
+
+	p.srgb = true
+}
+
+// ToSRGB returns a copy of img, whose colors are described by p, converted to sRGB.
+func (p *Profile) ToSRGB(img image.Image) *image.NRGBA {
+	out := iconpatch.ToNRGBA(img)
+	if p.IsSRGB() {
+		return out
+	}
+
+	conversion := xyzToSRGB.mul(p.toXYZ)
+
+	var linear [3][256]float64
+	for c := 0; c < 3; c++ {
+		for v := 0; v < 256; v++ {
+			linear[c][v] = p.trc[c](float64(v) / 255)
+		}
+	}
+
+	const encodeSteps = 4096
+	var encode [encodeSteps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(srgbEncode(float64(i)/encodeSteps) * 255))
+	}
+
+	for i := 0; i+3 < len(out.Pix); i += 4 {
+		px := out.Pix[i : i+4 : i+4]
+		r, g, b := linear[0][px[0]], linear[1][px[1]], linear[2][px[2]]
+
+		for c := 0; c < 3; c++ {
+			v := conversion[c][0]*r + conversion[c][1]*g + conversion[c][2]*b
+			// Written so that NaN ends up as 0 too.
+			if !(v >= 0) {
+				v = 0
+			} else if v > 1 {
+				v = 1
+			}
+			px[c] = encode[int(v*encodeSteps+0.5)]
+		}
+	}
+
+	return out
+}
+
+// sanitizeName keeps profile names usable as HTTP header values.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7E {
+			return -1
+		}
+
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	if name == "" {
+		return "unnamed"
+	}
+
+	return name
+}
@@ -0,0 +1,105 @@
+package colorprofile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// withChunks inserts chunks right after the IHDR chunk of a PNG file.
+func withChunks(t *testing.T, data []byte, chunks map[string][]byte) []byte {
+	t.Helper()
+
+	// Signature, then IHDR: length, type, 13 bytes of data and CRC.
+	ihdrEnd := 8 + 8 + 13 + 4
+
+	out := append([]byte{}, data[:ihdrEnd]...)
+	for _, kind := range []string{"gAMA", "cHRM"} {
+		chunk, ok := chunks[kind]
+		if !ok {
+			continue
+		}
+
+		out = binary.BigEndian.AppendUint32(out, uint32(len(chunk)))
+		start := len(out)
+		out = append(out, kind...)
+		out = append(out, chunk...)
+		out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+	}
+
+	return append(out, data[ihdrEnd:]...)
+}
+
+func encodePNG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.NRGBA{R: 200, G: 40, B: 90, A: 255})
+	img.Set(1, 1, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func fixed(values ...float64) []byte {
+	var out []byte
+	for _, v := range values {
+		out = binary.BigEndian.AppendUint32(out, uint32(v*100000))
+	}
+
+	return out
+}
+
+// Degenerate primaries give a singular matrix, which used to turn into NaN
+// colors and an out of range index in ToSRGB.
+func TestDegenerateChromaticities(t *testing.T) {
+	data := withChunks(t, encodePNG(t), map[string][]byte{
+		"gAMA": fixed(1),
+		"cHRM": fixed(0.3127, 0.329, 0.3, 0.3, 0.3, 0.3, 0.3, 0.3),
+	})
+
+	profile, err := FromPNG(data)
+	if err != nil && !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("FromPNG: %v", err)
+	}
+
+	if profile == nil {
+		t.Fatal("FromPNG returned no profile")
+	}
+
+	if !profile.toXYZ.finite() {
+		t.Errorf("matrix is not finite: %v", profile.toXYZ)
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile.ToSRGB(img)
+}
+
+func TestSingularMatrix(t *testing.T) {
+	if _, ok := (matrix{{1, 2, 3}, {2, 4, 6}, {0, 0, 1}}).inverse(); ok {
+		t.Error("inverse of a singular matrix succeeded")
+	}
+
+	nan := matrix{{nan(), 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	if nan.close(nan, 0.1) {
+		t.Error("NaN matrix reported close to itself")
+	}
+}
+
+func nan() float64 {
+	var zero float64
+	return zero / zero
+}
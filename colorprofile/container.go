@@ -0,0 +1,214 @@
+package colorprofile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxProfileSize bounds the ICC data we are willing to inflate or reassemble.
+const maxProfileSize = 4 << 20
+
+// FromPNG returns the color profile of a PNG file, following the precedence of
+// the PNG specification: iCCP, then sRGB, then gAMA and cHRM. It returns nil
+// when the file does not describe its colors.
+func FromPNG(data []byte) (*Profile, error) {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1A\n")) {
+		return nil, errors.New("colorprofile: not a PNG file")
+	}
+
+	var gamma, chromaticities []byte
+	srgb := false
+
+	for offset := 8; offset+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		kind := string(data[offset+4 : offset+8])
+		start := offset + 8
+		if length < 0 || start+length > len(data) {
+			break
+		}
+
+		chunk := data[start : start+length]
+		offset = start + length + 4 // CRC
+
+		switch kind {
+		case "iCCP":
+			return pngICCProfile(chunk)
+		case "sRGB":
+			srgb = true
+		case "gAMA":
+			gamma = chunk
+		case "cHRM":
+			chromaticities = chunk
+		case "IDAT", "IEND":
+			offset = len(data)
+		}
+	}
+
+	if srgb {
+		return &Profile{Name: "sRGB", srgb: true}, nil
+	}
+
+	if len(gamma) != 4 && len(chromaticities) != 32 {
+		return nil, nil
+	}
+
+	p := &Profile{Name: "PNG", toXYZ: srgbToXYZ}
+	trc := curve(srgbCurve)
+
+	if len(gamma) == 4 {
+		g := float64(binary.BigEndian.Uint32(gamma)) / 100000
+		if g > 0 {
+			// gAMA holds the encoding exponent.
+			p.Name = fmt.Sprintf("gamma %.2f", 1/g)
+			trc = gammaCurve(1 / g)
+		}
+	}
+
+	if len(chromaticities) == 32 {
+		var xy [8]float64
+		for i := range xy {
+			xy[i] = float64(binary.BigEndian.Uint32(chromaticities[4*i:])) / 100000
+		}
+
+		if m, ok := chromaticityMatrix(xy); ok {
+			p.toXYZ = m
+			p.Name += " with chromaticities"
+		}
+	}
+
+	p.trc = [3]curve{trc, trc, trc}
+	if err := p.finish(); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+func pngICCProfile(chunk []byte) (*Profile, error) {
+	// profile name, null separator, compression method (always zlib)
+	sep := bytes.IndexByte(chunk, 0)
+	if sep < 0 || sep+2 > len(chunk) {
+		return nil, errTruncated
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(chunk[sep+2:]))
+	if err != nil {
+		return nil, fmt.Errorf("colorprofile: iCCP: %w", err)
+	}
+	defer zr.Close()
+
+	icc, err := io.ReadAll(io.LimitReader(zr, maxProfileSize))
+	if err != nil {
+		return nil, fmt.Errorf("colorprofile: iCCP: %w", err)
+	}
+
+	return ParseICC(icc)
+}
+
+// FromJPEG reassembles the ICC profile spread over the APP2 segments of a
+// JPEG file. It returns nil when there is none.
+func FromJPEG(data []byte) (*Profile, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("colorprofile: not a JPEG file")
+	}
+
+	const iccMarker = "ICC_PROFILE\x00"
+	var parts [][]byte
+	size := 0
+
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xFF {
+			break
+		}
+
+		marker := data[offset+1]
+		if marker == 0xFF {
+			// fill byte
+			offset++
+			continue
+		}
+
+		// Markers without a payload.
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			offset += 2
+			continue
+		}
+
+		// Image data starts, profiles must come before.
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			break
+		}
+
+		segment := data[offset+4 : offset+2+length]
+		offset += 2 + length
+
+		if marker != 0xE2 || !bytes.HasPrefix(segment, []byte(iccMarker)) || len(segment) < len(iccMarker)+2 {
+			continue
+		}
+
+		seq, count := int(segment[len(iccMarker)]), int(segment[len(iccMarker)+1])
+		if seq == 0 || seq > count {
+			return nil, errors.New("colorprofile: invalid ICC_PROFILE segment numbering")
+		}
+
+		if parts == nil {
+			parts = make([][]byte, count)
+		}
+
+		if count != len(parts) {
+			return nil, errors.New("colorprofile: inconsistent ICC_PROFILE segment count")
+		}
+
+		parts[seq-1] = segment[len(iccMarker)+2:]
+		size += len(parts[seq-1])
+		if size > maxProfileSize {
+			return nil, errors.New("colorprofile: ICC profile too large")
+		}
+	}
+
+	if parts == nil {
+		return nil, nil
+	}
+
+	for _, part := range parts {
+		if part == nil {
+			return nil, errors.New("colorprofile: missing ICC_PROFILE segment")
+		}
+	}
+
+	return ParseICC(bytes.Join(parts, nil))
+}
+
+// FromWebP returns the profile stored in the ICCP chunk of an extended WebP
+// file, or nil when there is none.
+func FromWebP(data []byte) (*Profile, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("colorprofile: not a WebP file")
+	}
+
+	for offset := 12; offset+8 <= len(data); {
+		kind := string(data[offset : offset+4])
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		start := offset + 8
+		if length < 0 || start+length > len(data) {
+			break
+		}
+
+		if kind == "ICCP" {
+			return ParseICC(data[start : start+length])
+		}
+
+		offset = start + length + length&1
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,229 @@
+package colorprofile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf16"
+)
+
+var errTruncated = errors.New("colorprofile: truncated profile")
+
+// ParseICC reads an ICC profile. Only RGB profiles made of a matrix and tone
+// reproduction curves can be used for conversion, for others the returned
+// error wraps ErrUnsupported and the profile still carries its name.
+func ParseICC(data []byte) (*Profile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("colorprofile: not an ICC profile")
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:132]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(data) {
+			return nil, errTruncated
+		}
+
+		offset := int(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(data) || offset+size < offset {
+			return nil, errTruncated
+		}
+
+		tags[string(data[entry:entry+4])] = data[offset : offset+size]
+	}
+
+	p := &Profile{Name: sanitizeName(description(tags["desc"]))}
+
+	if string(data[16:20]) != "RGB " {
+		return p, fmt.Errorf("%w: %q color space", ErrUnsupported, data[16:20])
+	}
+
+	for i, name := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		xyz, err := parseXYZ(tags[name])
+		if err != nil {
+			return p, fmt.Errorf("%w: %s: %w", ErrUnsupported, name, err)
+		}
+
+		// Columns of the matrix are the XYZ values of each primary.
+		for row := 0; row < 3; row++ {
+			p.toXYZ[row][i] = xyz[row]
+		}
+	}
+
+	for i, name := range []string{"rTRC", "gTRC", "bTRC"} {
+		trc, err := parseCurve(tags[name])
+		if err != nil {
+			return p, fmt.Errorf("%w: %s: %w", ErrUnsupported, name, err)
+		}
+
+		p.trc[i] = trc
+	}
+
+	if err := p.finish(); err != nil {
+		return p, err
+	}
+
+	return p, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseXYZ(tag []byte) ([3]float64, error) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, errors.New("missing or invalid XYZ tag")
+	}
+
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, nil
+}
+
+func parseCurve(tag []byte) (curve, error) {
+	if len(tag) < 12 {
+		return nil, errors.New("missing or invalid curve tag")
+	}
+
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:12]))
+		if len(tag) < 12+2*n {
+			return nil, errTruncated
+		}
+
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			return gammaCurve(float64(binary.BigEndian.Uint16(tag[12:])) / 256), nil
+		}
+
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+		}
+
+		return func(v float64) float64 {
+			pos := v * float64(n-1)
+			i := int(pos)
+			if i >= n-1 {
+				return table[n-1]
+			}
+
+			frac := pos - float64(i)
+			return table[i]*(1-frac) + table[i+1]*frac
+		}, nil
+	case "para":
+		return parseParametricCurve(tag)
+	}
+
+	return nil, fmt.Errorf("unknown curve type %q", tag[:4])
+}
+
+// parseParametricCurve reads the five function types of ICC.1:2010, section 10.18.
+func parseParametricCurve(tag []byte) (curve, error) {
+	paramCounts := []int{1, 3, 4, 5, 7}
+
+	function := int(binary.BigEndian.Uint16(tag[8:10]))
+	if function >= len(paramCounts) {
+		return nil, fmt.Errorf("unknown parametric function %d", function)
+	}
+
+	if len(tag) < 12+4*paramCounts[function] {
+		return nil, errTruncated
+	}
+
+	var p [7]float64
+	for i := 0; i < paramCounts[function]; i++ {
+		p[i] = s15Fixed16(tag[12+4*i:])
+	}
+
+	g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+
+	pow := func(v float64) float64 {
+		if v <= 0 {
+			return 0
+		}
+
+		return math.Pow(v, g)
+	}
+
+	switch function {
+	case 0:
+		return gammaCurve(g), nil
+	case 1:
+		return func(v float64) float64 {
+			if v >= -b/a {
+				return pow(a*v + b)
+			}
+			return 0
+		}, nil
+	case 2:
+		return func(v float64) float64 {
+			if v >= -b/a {
+				return pow(a*v+b) + c
+			}
+			return c
+		}, nil
+	case 3:
+		return func(v float64) float64 {
+			if v >= d {
+				return pow(a*v + b)
+			}
+			return c * v
+		}, nil
+	default:
+		return func(v float64) float64 {
+			if v >= d {
+				return pow(a*v+b) + e
+			}
+			return c*v + f
+		}, nil
+	}
+}
+
+// description reads the desc tag, either a textDescriptionType (ICC v2) or
+// a multiLocalizedUnicodeType (ICC v4).
+func description(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:12]))
+		if n <= 0 || 12+n > len(tag) {
+			return ""
+		}
+
+		s := tag[12 : 12+n]
+		for len(s) > 0 && s[len(s)-1] == 0 {
+			s = s[:len(s)-1]
+		}
+
+		return string(s)
+	case "mluc":
+		records := int(binary.BigEndian.Uint32(tag[8:12]))
+		if records == 0 || len(tag) < 16+12 {
+			return ""
+		}
+
+		// The first record is as good as any other.
+		length := int(binary.BigEndian.Uint32(tag[20:24]))
+		offset := int(binary.BigEndian.Uint32(tag[24:28]))
+		if offset+length > len(tag) || offset+length < offset {
+			return ""
+		}
+
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+
+		return string(utf16.Decode(units))
+	}
+
+	return ""
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"faviconapi/favicon"
+	"net"
+	"net/http"
+)
+
+// ErrorCode is the machine-readable reason of a failed request, stable across versions.
+type ErrorCode string
+
+const (
+	CodeInvalidURL          ErrorCode = "invalid_url"
+	CodeInvalidParameter    ErrorCode = "invalid_parameter"
+	CodeUpstreamUnreachable ErrorCode = "upstream_unreachable"
+	CodeUpstreamTimeout     ErrorCode = "upstream_timeout"
+	CodeTLSError            ErrorCode = "tls_error"
+	CodeIconNotFound        ErrorCode = "icon_not_found"
+	CodeDecodeFailed        ErrorCode = "decode_failed"
+	CodeIconTooLarge        ErrorCode = "icon_too_large"
+	CodeStorageError        ErrorCode = "storage_error"
+	CodeRateLimited         ErrorCode = "rate_limited"
+	CodeUnauthorized        ErrorCode = "unauthorized"
+	CodeUnexpected          ErrorCode = "unexpected_error"
+)
+
+// errorStatuses holds the HTTP status and the message returned for each code.
+// Messages are fixed so that responses do not leak details about our network.
+var errorStatuses = map[ErrorCode]struct {
+	Status  int
+	Message string
+}{
+	CodeInvalidURL:          {http.StatusBadRequest, "url field must be a valid url"},
+	CodeUpstreamUnreachable: {http.StatusBadGateway, "unreachable server"},
+	CodeUpstreamTimeout:     {http.StatusGatewayTimeout, "upstream server timed out"},
+	CodeTLSError:            {http.StatusBadGateway, "tls handshake with upstream server failed"},
+	CodeIconNotFound:        {http.StatusNotFound, "icon not found"},
+	CodeDecodeFailed:        {http.StatusBadGateway, "cannot decode icon"},
+	CodeIconTooLarge:        {http.StatusBadGateway, "icon too large"},
+	CodeStorageError:        {http.StatusServiceUnavailable, "storage error"},
+	CodeRateLimited:         {http.StatusTooManyRequests, "rate limited by upstream server"},
+	CodeUnauthorized:        {http.StatusUnauthorized, "admin token required"},
+	CodeUnexpected:          {http.StatusInternalServerError, "unexpected error"},
+}
+
+// ParameterError reports an invalid query parameter.
+type ParameterError struct {
+	Message string
+}
+
+func (e *ParameterError) Error() string {
+	return e.Message
+}
+
+// classifyError finds the code of err. Causes are checked before the
+// ErrUnreachableServer wrapping them.
+func classifyError(err error) ErrorCode {
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var paramErr *ParameterError
+
+	switch {
+	case errors.As(err, &paramErr):
+		return CodeInvalidParameter
+	case errors.Is(err, errInvalidTargetURL), errors.Is(err, errTargetURLTooLong):
+		return CodeInvalidURL
+	case errors.Is(err, favicon.ErrUpstreamRateLimited):
+		return CodeRateLimited
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return CodeUpstreamTimeout
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr):
+		return CodeTLSError
+	case errors.Is(err, favicon.ErrUnreachableServer):
+		return CodeUpstreamUnreachable
+	case errors.Is(err, favicon.ErrIconTooLarge):
+		return CodeIconTooLarge
+	case errors.Is(err, favicon.ErrDecodeFailed):
+		return CodeDecodeFailed
+	case errors.Is(err, favicon.ErrIconNotFound):
+		return CodeIconNotFound
+	case errors.Is(err, ErrStorage):
+		return CodeStorageError
+	default:
+		return CodeUnexpected
+	}
+}
+
+// errorResponse turns err into a response carrying its code. Errors on our
+// side are logged, upstream ones are expected.
+func errorResponse(ctx Context, err error) HttpResponse {
+	code := classifyError(err)
+	if code == CodeUnexpected {
+		return unexpectedError(ctx, err)
+	}
+
+	if code == CodeStorageError {
+		ctx.log.Error().Err(err).Send()
+	}
+
+	if code == CodeInvalidParameter {
+		return invalidParameter(err.Error())
+	}
+
+	return HttpResponse{
+		Status: errorStatuses[code].Status,
+		Value:  errorStatuses[code].Message,
+		Error:  code,
+	}
+}
+
+// invalidParameter is the response to a request with a bad query parameter.
+func invalidParameter(message string) HttpResponse {
+	return HttpResponse{Status: http.StatusBadRequest, Value: message, Error: CodeInvalidParameter}
+}
+
+// requestID returns the X-Request-ID of r when it looks sane, a random one otherwise.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 128 {
+		valid := true
+		for _, c := range id {
+			if c <= ' ' || c > '~' {
+				valid = false
+				break
+			}
+		}
+
+		if valid {
+			return id
+		}
+	}
+
+	var id [16]byte
+	_, _ = rand.Read(id[:])
+
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"faviconapi/favicon"
+	"faviconapi/iconpatch"
+	"net/http"
+)
+
+// GetExplainEndpoint resolves the icon of a site like GetFaviconEndpoint
+// would, bypassing the caches and without storing anything, and returns what
+// was considered along the way. Meta holds what would have been stored along
+// with the icon.
+func GetExplainEndpoint(ctx Context, rw http.ResponseWriter, r *http.Request) HttpResponse {
+	target, err := parseTargetURL(r, "/api/v1/explain")
+	if err != nil {
+		return errorResponse(ctx, err)
+	}
+
+	pipeline, err := iconpatch.ParsePipeline(r.URL.Query().Get("transform"))
+	if err != nil {
+		return invalidParameter(err.Error())
+	}
+
+	explainCtx, explanation := favicon.WithExplanation(ctx.requestContext(), target.String())
+
+	ctx.limiter.Take()
+
+	icon, err := ctx.resolver.FindFaviconURL(explainCtx, target)
+	explanation.Outcome = resolutionOutcome(err)
+	if err != nil {
+		explanation.Code = string(classifyError(err))
+		explanation.Error = err.Error()
+		return HttpResponse{Success: true, Value: explanation}
+	}
+
+	bounds := icon.Image.Bounds()
+	explanation.Choice = &favicon.ExplainedChoice{
+		URL:          icon.URL,
+		Type:         icon.Type.String(),
+		Width:        bounds.Dx(),
+		Height:       bounds.Dy(),
+		PHash:        icon.PHash.String(),
+		ColorProfile: icon.ColorProfile,
+		Redirects:    icon.Redirects,
+	}
+
+	if icon.Animation != nil {
+		explanation.Choice.Frames = len(icon.Animation.Frames)
+	}
+
+	req := ResolveRequest{URL: target, Pipeline: pipeline, Animation: favicon.AnimationFirst}
+
+	patched, err := favicon.PatchIcon(icon, req.Pipeline, req.Animation)
+	if err != nil {
+		return errorResponse(ctx, err)
+	}
+
+	return HttpResponse{Success: true, Value: explanation, Meta: iconMeta(req, icon, patched)}
+}
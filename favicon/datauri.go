@@ -0,0 +1,63 @@
+package favicon
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var errInvalidDataURI = errors.New("invalid data uri")
+
+func isDataURI(uri string) bool {
+	return len(uri) > 5 && strings.EqualFold(uri[:5], "data:")
+}
+
+// decodeDataURI decodes an RFC 2397 data URI, returning its media type and payload.
+func decodeDataURI(uri string) (string, []byte, error) {
+	if !isDataURI(uri) {
+		return "", nil, errInvalidDataURI
+	}
+
+	header, payload, ok := strings.Cut(uri[5:], ",")
+	if !ok {
+		return "", nil, errInvalidDataURI
+	}
+
+	mediaType, isBase64 := header, false
+	if len(header) >= 7 && strings.EqualFold(header[len(header)-7:], ";base64") {
+		mediaType, isBase64 = header[:len(header)-7], true
+	}
+
+	if mediaType == "" {
+		mediaType = "text/plain;charset=US-ASCII"
+	}
+
+	// Payloads are often percent-encoded, even when they are in base64.
+	unescaped, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, errInvalidDataURI
+	}
+
+	if !isBase64 {
+		return mediaType, []byte(unescaped), nil
+	}
+
+	unescaped = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+
+		return r
+	}, unescaped)
+
+	data, err := base64.StdEncoding.DecodeString(unescaped)
+	if err != nil {
+		data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(unescaped, "="))
+		if err != nil {
+			return "", nil, errInvalidDataURI
+		}
+	}
+
+	return mediaType, data, nil
+}
@@ -0,0 +1,147 @@
+package favicon
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Explanation is the decision trace of a resolution, filled in by the
+// Resolver when one is attached to the context with WithExplanation.
+type Explanation struct {
+	URL     string           `json:"url"`
+	Fetches []ExplainedFetch `json:"fetches"`
+	// DocumentURL is what relative links were resolved against, after
+	// redirects and <base href>.
+	DocumentURL string `json:"documentUrl,omitempty"`
+	BaseHref    string `json:"baseHref,omitempty"`
+	// Ranking tells how the candidates are ordered, see ExplainedCandidate.
+	Ranking    string               `json:"ranking"`
+	Candidates []ExplainedCandidate `json:"candidates"`
+	Choice     *ExplainedChoice     `json:"choice"`
+	Outcome    string               `json:"outcome"`
+	// Code is the error code the resolve endpoint would answer, Error the
+	// full error it does not show.
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type ExplainedFetch struct {
+	URL string `json:"url"`
+	// Purpose is "icon" or "html".
+	Purpose     string   `json:"purpose"`
+	Status      int      `json:"status,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+	Sniffed     string   `json:"sniffed,omitempty"`
+	Bytes       int      `json:"bytes,omitempty"`
+	Redirects   []string `json:"redirects,omitempty"`
+	DurationMs  float64  `json:"durationMs"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// ExplainedCandidate is an icon FindFaviconURL could have used, the
+// /favicon.ico probe first, then the <link> elements in the order they
+// are tried, the last one in the document first. Links that are not usable
+// icons are listed too, rejected without being tried.
+type ExplainedCandidate struct {
+	Href  string `json:"href"`
+	URL   string `json:"url,omitempty"`
+	Rel   string `json:"rel,omitempty"`
+	Type  string `json:"type,omitempty"`
+	Sizes string `json:"sizes,omitempty"`
+	// Order is the position of the link in the document, the only thing
+	// links are ranked by: the highest is tried first. Sizes and types are
+	// not compared.
+	Order    int    `json:"order"`
+	Tried    bool   `json:"tried"`
+	Rejected string `json:"rejected,omitempty"`
+	Chosen   bool   `json:"chosen"`
+}
+
+type ExplainedChoice struct {
+	URL          string   `json:"url"`
+	Type         string   `json:"type"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	Frames       int      `json:"frames,omitempty"`
+	PHash        string   `json:"phash"`
+	ColorProfile string   `json:"colorProfile,omitempty"`
+	Redirects    []string `json:"redirects,omitempty"`
+}
+
+type explanationKey struct{}
+
+// candidateRanking is the Ranking of every Explanation.
+const candidateRanking = "/favicon.ico first, then the icon links by descending order, the last one in the document first; sizes and types are not compared"
+
+// WithExplanation returns a context making the Resolver record what it does
+// in the returned Explanation.
+func WithExplanation(ctx context.Context, URL string) (context.Context, *Explanation) {
+	explanation := &Explanation{URL: URL, Ranking: candidateRanking, Fetches: []ExplainedFetch{}, Candidates: []ExplainedCandidate{}}
+
+	return context.WithValue(ctx, explanationKey{}, explanation), explanation
+}
+
+// explanationFrom returns the Explanation attached to ctx, if any. Its
+// methods do nothing on a nil Explanation.
+func explanationFrom(ctx context.Context) *Explanation {
+	explanation, _ := ctx.Value(explanationKey{}).(*Explanation)
+	return explanation
+}
+
+// addFetch records a request, res and err being its outcome.
+func (e *Explanation) addFetch(fetch ExplainedFetch, start time.Time, res *http.Response, err error) {
+	if e == nil {
+		return
+	}
+
+	fetch.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+
+	if res != nil {
+		fetch.Status = res.StatusCode
+		fetch.ContentType = res.Header.Get("Content-Type")
+		if chain := redirectChain(res); len(chain) > 1 {
+			fetch.Redirects = chain
+		}
+	}
+
+	if err != nil {
+		fetch.Error = err.Error()
+	}
+
+	e.Fetches = append(e.Fetches, fetch)
+}
+
+// addCandidate records a candidate and returns its index for markCandidate.
+func (e *Explanation) addCandidate(candidate ExplainedCandidate) int {
+	if e == nil {
+		return -1
+	}
+
+	e.Candidates = append(e.Candidates, candidate)
+
+	return len(e.Candidates) - 1
+}
+
+// markCandidate records that candidate i was tried, err being why it was rejected.
+func (e *Explanation) markCandidate(i int, err error) {
+	if e == nil {
+		return
+	}
+
+	e.Candidates[i].Tried = true
+	if err != nil {
+		e.Candidates[i].Rejected = err.Error()
+	} else {
+		e.Candidates[i].Chosen = true
+	}
+}
+
+func (e *Explanation) setDocument(documentURL string, baseHref string) {
+	if e == nil {
+		return
+	}
+
+	e.DocumentURL = documentURL
+	e.BaseHref = baseHref
+}
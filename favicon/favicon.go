@@ -0,0 +1,412 @@
+// Package favicon finds the icon of a site, downloads it, decodes it and runs
+// it through an iconpatch pipeline.
+package favicon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"faviconapi/animation"
+	"faviconapi/colorprofile"
+	_ "faviconapi/ico"
+	"faviconapi/iconhash"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnreachableServer = errors.New("unreachable server")
+	ErrIconNotFound      = errors.New("icon not found")
+	ErrIconTooLarge      = errors.New("icon too large")
+	ErrDecodeFailed      = errors.New("cannot decode icon")
+	// ErrUpstreamRateLimited is returned when the site answers 429 Too Many Requests.
+	ErrUpstreamRateLimited = errors.New("rate limited by upstream server")
+)
+
+// PlaceholderError is returned for icons matching the placeholder blocklist.
+type PlaceholderError struct {
+	Name string
+	Hash iconhash.Hash
+}
+
+func (e *PlaceholderError) Error() string {
+	return fmt.Sprintf("placeholder icon %q (%s)", e.Name, e.Hash)
+}
+
+func (e *PlaceholderError) Unwrap() error {
+	return ErrIconNotFound
+}
+
+type ResolvedIcon struct {
+	URL  string
+	Type IconType
+	// Data holds the icon file as downloaded, Image its decoded form.
+	Data  []byte
+	Image image.Image
+	// PHash is the perceptual hash of Image.
+	PHash iconhash.Hash
+	// ColorProfile names the profile Image was converted from, empty when the
+	// file did not describe its colors.
+	ColorProfile string
+	// Animation is set for animated icons, Image being their first frame.
+	Animation *animation.Animation
+	// Redirects holds every URL requested to download the icon, starting with
+	// the one we asked for and ending with URL.
+	Redirects []string
+}
+
+func (r *Resolver) FindFaviconURL(ctx context.Context, URL *url.URL) (icon *ResolvedIcon, err error) {
+	ctx, span := tracer.Start(ctx, "FindFaviconURL", trace.WithAttributes(semconv.URLFull(URL.String())))
+	defer func() { endSpan(span, err) }()
+
+	baseURL := getBaseURL(URL)
+
+	explanation := explanationFrom(ctx)
+	probe := explanation.addCandidate(ExplainedCandidate{Href: "/favicon.ico", URL: baseURL + "/favicon.ico"})
+
+	probeCtx, probeSpan := tracer.Start(ctx, "probe favicon.ico")
+	icon, err = r.fetchIcon(probeCtx, baseURL+"/favicon.ico", false)
+	endSpan(probeSpan, err)
+	explanation.markCandidate(probe, err)
+	if err == nil {
+		return icon, nil
+	}
+
+	if !probeRejected(err) {
+		return nil, unreachable(err)
+	}
+
+	baseHref, links, res, err := r.fetchLinks(ctx, URL.String())
+	if err != nil {
+		return nil, unreachable(err)
+	}
+
+	// Relative references are resolved against <base href>, itself relative
+	// to the document URL we ended up on after redirects (RFC 3986, section 5).
+	documentURL := res.Request.URL
+	if baseHref != "" {
+		if parsedBaseURL, err := documentURL.Parse(baseHref); err == nil {
+			documentURL = parsedBaseURL
+		}
+	}
+
+	explanation.setDocument(documentURL.String(), baseHref)
+
+	// The next candidate is tried whenever one is rejected, the error
+	// returned is the one of the last candidate.
+	err = ErrIconNotFound
+	candidates := make([]int, len(links))
+	for i, link := range links {
+		candidate := ExplainedCandidate{Href: link.Href, Rel: link.Rel, Type: link.Type, Sizes: link.Sizes, Order: link.Order, Rejected: link.Skip}
+		if iconURL, err := documentURL.Parse(link.Href); err == nil && link.Href != "" && !isDataURI(link.Href) {
+			candidate.URL = iconURL.String()
+		}
+
+		candidates[i] = explanation.addCandidate(candidate)
+	}
+
+	for i, link := range links {
+		if link.Skip != "" {
+			continue
+		}
+
+		if isDataURI(link.Href) {
+			icon, err = r.loadDataIcon(ctx, link.Href)
+		} else {
+			iconURL, parseErr := documentURL.Parse(link.Href)
+			if parseErr != nil || (iconURL.Scheme != "http" && iconURL.Scheme != "https") || iconURL.Host == "" {
+				explanation.markCandidate(candidates[i], errors.New("not an http(s) URL"))
+				continue
+			}
+
+			icon, err = r.fetchIcon(ctx, iconURL.String(), true)
+		}
+
+		explanation.markCandidate(candidates[i], err)
+
+		if err == nil {
+			return icon, nil
+		}
+	}
+
+	if isRejection(err) || errors.Is(err, ErrIconTooLarge) {
+		return nil, err
+	}
+
+	return nil, unreachable(err)
+}
+
+// unreachable wraps err in ErrUnreachableServer, keeping the cause around to
+// tell timeouts and TLS failures apart. Rate limiting is reported as is.
+func unreachable(err error) error {
+	if errors.Is(err, ErrUpstreamRateLimited) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrUnreachableServer, err)
+}
+
+// fetchLinks downloads the HTML page at URL and extracts its links.
+func (r *Resolver) fetchLinks(ctx context.Context, URL string) (baseHref string, links []iconLink, res *http.Response, err error) {
+	ctx, span := tracer.Start(ctx, "fetch HTML", trace.WithAttributes(semconv.URLFull(URL)))
+	defer func() { endSpan(span, err) }()
+
+	start := time.Now()
+	res, err = r.doRequest(ctx, "GET", URL, true)
+	if err != nil {
+		explanationFrom(ctx).addFetch(ExplainedFetch{URL: URL, Purpose: "html"}, start, nil, err)
+		return "", nil, nil, err
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		_ = res.Body.Close()
+		explanationFrom(ctx).addFetch(ExplainedFetch{URL: URL, Purpose: "html"}, start, res, ErrUpstreamRateLimited)
+		return "", nil, nil, ErrUpstreamRateLimited
+	}
+
+	baseHref, links = parseIconLinks(res.Body)
+	_ = res.Body.Close()
+
+	explanationFrom(ctx).addFetch(ExplainedFetch{URL: URL, Purpose: "html"}, start, res, nil)
+
+	span.SetAttributes(attribute.Int("links", len(links)))
+
+	return baseHref, links, res, nil
+}
+
+// isRejection reports whether err means that we got an answer, which is just not an icon we want.
+func isRejection(err error) bool {
+	return errors.Is(err, ErrIconNotFound) || errors.Is(err, ErrDecodeFailed)
+}
+
+// probeRejected reports whether the /favicon.ico probe failed in a way that
+// says nothing of the site itself, its <link> icons being tried then: the
+// answer is not an icon we want, or is too large or too slow to download.
+func probeRejected(err error) bool {
+	var netErr net.Error
+
+	return isRejection(err) || isRedirectPolicyError(err) ||
+		errors.Is(err, ErrIconTooLarge) || errors.Is(err, errReadBody) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errReadBody wraps the errors met while reading the body of an icon, after
+// the server answered.
+var errReadBody = errors.New("cannot read icon")
+
+// fetchIcon downloads, sniffs and decodes the icon at URL.
+func (r *Resolver) fetchIcon(ctx context.Context, URL string, allowDomainChange bool) (*ResolvedIcon, error) {
+	downloadCtx, span := tracer.Start(ctx, "download icon", trace.WithAttributes(semconv.URLFull(URL)))
+
+	data, iconType, res, err := r.downloadIcon(downloadCtx, URL, allowDomainChange)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.decodeIcon(ctx, &ResolvedIcon{
+		URL:       res.Request.URL.String(),
+		Type:      iconType,
+		Data:      data,
+		Redirects: redirectChain(res),
+	})
+}
+
+func (r *Resolver) downloadIcon(ctx context.Context, URL string, allowDomainChange bool) (data []byte, iconType IconType, res *http.Response, err error) {
+	fetch := ExplainedFetch{URL: URL, Purpose: "icon"}
+	start := time.Now()
+	defer func() {
+		fetch.Bytes = len(data)
+		explanationFrom(ctx).addFetch(fetch, start, res, err)
+	}()
+
+	res, err = r.doRequest(ctx, "GET", URL, allowDomainChange)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer res.Body.Close()
+
+	iconType, head, err := sniffIcon(res.Body, res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, 0, res, err
+	}
+
+	fetch.Sniffed = iconType.String()
+
+	data, err = io.ReadAll(io.LimitReader(io.MultiReader(bytes.NewReader(head), res.Body), r.opts.MaxIconSize+1))
+	if err != nil {
+		return nil, 0, res, fmt.Errorf("%w: %w", errReadBody, err)
+	}
+
+	if int64(len(data)) > r.opts.MaxIconSize {
+		return nil, 0, res, ErrIconTooLarge
+	}
+
+	return data, iconType, res, nil
+}
+
+func (r *Resolver) loadDataIcon(ctx context.Context, uri string) (*ResolvedIcon, error) {
+	mediaType, data, err := decodeDataURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIconNotFound, err)
+	}
+
+	return r.LoadIcon(ctx, "data:"+mediaType, mediaType, data)
+}
+
+// LoadIcon sniffs and decodes an icon that is already at hand, such as a local
+// file. name takes the place of its URL, mediaType of its Content-Type and may
+// be empty.
+func (r *Resolver) LoadIcon(ctx context.Context, name, mediaType string, data []byte) (*ResolvedIcon, error) {
+	if int64(len(data)) > r.opts.MaxIconSize {
+		return nil, ErrIconTooLarge
+	}
+
+	iconType, reason := sniffBytes(data, mediaType)
+	if reason != "" {
+		return nil, &SniffError{Reason: reason, ContentType: mediaType, Head: data[:min(len(data), sniffLen)]}
+	}
+
+	return r.decodeIcon(ctx, &ResolvedIcon{
+		URL:  name,
+		Type: iconType,
+		Data: data,
+	})
+}
+
+// decodeIcon fills in Image and PHash, rejecting known placeholder icons.
+// Images are converted to sRGB when they come with another color profile.
+func (r *Resolver) decodeIcon(ctx context.Context, icon *ResolvedIcon) (_ *ResolvedIcon, err error) {
+	_, span := tracer.Start(ctx, "decode icon", trace.WithAttributes(
+		attribute.String("icon.type", icon.Type.String()),
+		attribute.Int("icon.size", len(icon.Data)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	// image.Decode only returns the first frame of a GIF, and cannot read
+	// animated WebP files at all.
+	if icon.Type == Gif || icon.Type == Webp {
+		anim, err := animation.Decode(icon.Data)
+		if err != nil && !errors.Is(err, animation.ErrNotAnimated) {
+			return nil, fmt.Errorf("%w (%s, %s): %w", ErrDecodeFailed, icon.Type, icon.URL, err)
+		}
+
+		if err == nil && len(anim.Frames) > 1 {
+			icon.Animation = anim
+			icon.Image = anim.Frames[0].Image
+		}
+	}
+
+	if icon.Image == nil {
+		img, _, err := image.Decode(bytes.NewReader(icon.Data))
+		if err != nil {
+			return nil, fmt.Errorf("%w (%s, %s): %w", ErrDecodeFailed, icon.Type, icon.URL, err)
+		}
+
+		icon.Image = img
+	}
+
+	convertToSRGB(icon)
+
+	icon.PHash = iconhash.DHash(icon.Image)
+
+	if entry, ok := r.blocklist.Match(icon.PHash); ok {
+		return nil, &PlaceholderError{Name: entry.Name, Hash: icon.PHash}
+	}
+
+	return icon, nil
+}
+
+// convertToSRGB applies the color profile embedded in the icon file, if any.
+// Profiles we cannot read or apply leave the image untouched.
+func convertToSRGB(icon *ResolvedIcon) {
+	var profile *colorprofile.Profile
+	var err error
+
+	switch icon.Type {
+	case Png:
+		profile, err = colorprofile.FromPNG(icon.Data)
+	case Jpeg:
+		profile, err = colorprofile.FromJPEG(icon.Data)
+	case Webp:
+		profile, err = colorprofile.FromWebP(icon.Data)
+	}
+
+	if profile == nil {
+		return
+	}
+
+	icon.ColorProfile = profile.Name
+
+	if err != nil || profile.IsSRGB() {
+		return
+	}
+
+	if icon.Animation == nil {
+		icon.Image = profile.ToSRGB(icon.Image)
+		return
+	}
+
+	for i := range icon.Animation.Frames {
+		icon.Animation.Frames[i].Image = profile.ToSRGB(icon.Animation.Frames[i].Image)
+	}
+
+	icon.Image = icon.Animation.Frames[0].Image
+}
+
+func getBaseURL(URL *url.URL) string {
+	buf := &strings.Builder{}
+
+	buf.WriteString(URL.Scheme)
+	buf.WriteString("://")
+	buf.WriteString(URL.Host)
+
+	return buf.String()
+}
+
+func (r *Resolver) doRequest(ctx context.Context, method string, URL string, allowDomainChange bool) (*http.Response, error) {
+	parsedURL, err := url.ParseRequestURI(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport:     r.roundTripper,
+		Timeout:       r.opts.Timeout,
+		CheckRedirect: r.checkRedirect(allowDomainChange),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURL := getBaseURL(parsedURL)
+
+	// should bypass most WAFs
+	req.Header.Add("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:124.0) Gecko/20100101 Firefox/124.0")
+	req.Header.Add("DNT", "1")
+	req.Header.Add("Accept", "image/avif,image/webp,*/*")
+	req.Header.Add("Cache-Control", "no-cache")
+	req.Header.Add("Referer", baseURL)
+	req.Header.Add("Origin", baseURL)
+	req.Header.Add("Sec-Fetch-Dest", "image")
+	req.Header.Add("Sec-Fetch-Mode", "no-cors")
+	req.Header.Add("Sec-Fetch-Site", "same-origin")
+
+	return client.Do(req)
+}
@@ -0,0 +1,66 @@
+package favicon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"faviconapi/iconhash"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// encodeIcon draws a 32px icon, a diagonal gradient going the given way.
+func encodeIcon(t *testing.T, reversed bool) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			v := uint8((x + y) * 4)
+			if reversed {
+				v = 255 - v
+			}
+			img.SetNRGBA(x, y, color.NRGBA{R: v, G: v / 2, B: 200, A: 255})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDecodeIconPlaceholder(t *testing.T) {
+	placeholder := encodeIcon(t, false)
+
+	img, err := png.Decode(bytes.NewReader(placeholder))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocklist := iconhash.DefaultBlocklist()
+	blocklist.Entries = append(blocklist.Entries, iconhash.Entry{Hash: iconhash.DHash(img), Name: "test placeholder"})
+	r := &Resolver{blocklist: blocklist}
+
+	_, err = r.decodeIcon(context.Background(), &ResolvedIcon{URL: "/favicon.ico", Type: Png, Data: placeholder})
+
+	var placeholderErr *PlaceholderError
+	if !errors.As(err, &placeholderErr) {
+		t.Fatalf("got error %v, want a PlaceholderError", err)
+	}
+	if placeholderErr.Name != "test placeholder" || !errors.Is(err, ErrIconNotFound) {
+		t.Errorf("got %v, want the test placeholder reported as not found", err)
+	}
+
+	icon, err := r.decodeIcon(context.Background(), &ResolvedIcon{URL: "/favicon.ico", Type: Png, Data: encodeIcon(t, true)})
+	if err != nil {
+		t.Fatalf("other icon: %v", err)
+	}
+	if icon.Image == nil {
+		t.Error("other icon: Image not set")
+	}
+}
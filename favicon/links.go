@@ -0,0 +1,90 @@
+package favicon
+
+import (
+	"io"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+type iconLink struct {
+	Href  string
+	Rel   string
+	Type  string
+	Sizes string
+	// Order is the position of the link in the document.
+	Order int
+	// Skip tells why the link is not worth trying, empty for icons.
+	Skip string
+}
+
+// parseIconLinks reads the <head> of an HTML document and returns its first
+// <base href> along with every link, the last one first since it is the icon
+// browsers use. Links that are not usable icons have Skip set.
+func parseIconLinks(body io.Reader) (string, []iconLink) {
+	htmlTokens := html.NewTokenizer(body)
+
+	baseHref := ""
+	var links []iconLink
+
+	for {
+		tt := htmlTokens.Next()
+		if tt == html.ErrorToken { // includes EOF
+			break
+		} else if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		t := htmlTokens.Token()
+
+		if t.Data == "base" {
+			for _, attr := range t.Attr {
+				// Only the first <base> element is used by browsers.
+				if attr.Key == "href" && baseHref == "" {
+					baseHref = strings.TrimSpace(attr.Val)
+				}
+			}
+
+			continue
+		} else if t.Data == "body" {
+			break
+		} else if t.Data != "link" {
+			continue
+		}
+
+		link := iconLink{Order: len(links)}
+
+		for _, attr := range t.Attr {
+			switch attr.Key {
+			case "rel":
+				link.Rel = attr.Val
+			case "href":
+				link.Href = strings.TrimSpace(attr.Val)
+			case "type":
+				link.Type = attr.Val
+			case "sizes":
+				link.Sizes = attr.Val
+			}
+		}
+
+		switch {
+		case link.Rel != "shortcut icon" && link.Rel != "icon":
+			link.Skip = "not an icon rel"
+		case link.Href == "":
+			link.Skip = "no href"
+		case link.Type == "image/svg+xml":
+			link.Skip = "svg type"
+		case isDataURI(link.Href) && strings.HasPrefix(strings.ToLower(link.Href[5:]), "image/svg"):
+			link.Skip = "svg data URI"
+		case len(link.Href) > 4 && link.Href[len(link.Href)-4:] == ".svg":
+			link.Skip = "svg href"
+		}
+
+		links = append(links, link)
+	}
+
+	slices.Reverse(links)
+
+	return baseHref, links
+}
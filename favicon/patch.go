@@ -0,0 +1,129 @@
+package favicon
+
+import (
+	"bytes"
+	"faviconapi/animation"
+	"faviconapi/iconpatch"
+	"fmt"
+	"golang.org/x/image/draw"
+	"image"
+	"image/png"
+)
+
+// AnimationPolicy decides what becomes of animated icons.
+type AnimationPolicy string
+
+const (
+	// AnimationFirst keeps the first frame, as image.Decode does.
+	AnimationFirst AnimationPolicy = "first"
+	// AnimationRepresentative keeps the least transparent frame.
+	AnimationRepresentative AnimationPolicy = "representative"
+	// AnimationPreserve keeps every frame, the icon is stored as an animated GIF,
+	// or WebP when it was one.
+	AnimationPreserve AnimationPolicy = "preserve"
+)
+
+func ParseAnimationPolicy(s string) (AnimationPolicy, error) {
+	switch policy := AnimationPolicy(s); policy {
+	case "":
+		return AnimationFirst, nil
+	case AnimationFirst, AnimationRepresentative, AnimationPreserve:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("animation must be one of %s, %s or %s", AnimationFirst, AnimationRepresentative, AnimationPreserve)
+	}
+}
+
+type PatchedIcon struct {
+	// Result is the one of the still image, or of the first frame for preserved animations.
+	*iconpatch.Result
+	// Frames is only set when an animation is preserved.
+	Frames    []animation.Frame
+	LoopCount int
+	// WebP encodes preserved animations as WebP rather than GIF.
+	WebP bool
+}
+
+// Format is the file format Encode produces, png, gif or webp.
+func (p *PatchedIcon) Format() string {
+	switch {
+	case p.Frames == nil:
+		return "png"
+	case p.WebP:
+		return "webp"
+	default:
+		return "gif"
+	}
+}
+
+// Encode returns the icon as a PNG, or as a GIF or WebP for preserved animations.
+func (p *PatchedIcon) Encode() ([]byte, string, error) {
+	buf := new(bytes.Buffer)
+
+	if p.Frames != nil && p.WebP {
+		err := animation.EncodeWebP(buf, p.Frames, p.LoopCount)
+		return buf.Bytes(), "image/webp", err
+	}
+
+	if p.Frames != nil {
+		err := animation.EncodeGIF(buf, p.Frames, p.LoopCount)
+		return buf.Bytes(), "image/gif", err
+	}
+
+	err := png.Encode(buf, p.Image)
+	return buf.Bytes(), "image/png", err
+}
+
+// Map returns a copy of p with f applied to its image and to every frame.
+func (p *PatchedIcon) Map(f func(image.Image) *image.NRGBA) *PatchedIcon {
+	result := *p.Result
+	result.Image = f(p.Image)
+
+	mapped := &PatchedIcon{Result: &result, LoopCount: p.LoopCount, WebP: p.WebP}
+	for _, frame := range p.Frames {
+		mapped.Frames = append(mapped.Frames, animation.Frame{Image: f(frame.Image), Delay: frame.Delay})
+	}
+
+	return mapped
+}
+
+func PatchIcon(resolvedIcon *ResolvedIcon, pipeline iconpatch.Pipeline, policy AnimationPolicy) (*PatchedIcon, error) {
+	still := resolvedIcon.Image
+	if resolvedIcon.Animation != nil && policy == AnimationRepresentative {
+		still = resolvedIcon.Animation.Frames[resolvedIcon.Animation.Representative()].Image
+	}
+
+	res, err := pipeline.Run(still)
+	if err != nil {
+		return nil, fmt.Errorf("%w: PatchIcon(%s, %s): %w", ErrDecodeFailed, resolvedIcon.Type, resolvedIcon.URL, err)
+	}
+
+	patched := &PatchedIcon{Result: res}
+	if resolvedIcon.Animation == nil || policy != AnimationPreserve {
+		return patched, nil
+	}
+
+	patched.LoopCount = resolvedIcon.Animation.LoopCount
+	patched.WebP = resolvedIcon.Type == Webp
+
+	// Transforms such as trim may not give the same size for every frame,
+	// they are all fitted in the size of the first one.
+	size := res.Image.Bounds().Size()
+	for _, frame := range resolvedIcon.Animation.Frames {
+		frameRes, err := pipeline.Run(frame.Image)
+		if err != nil {
+			return nil, fmt.Errorf("%w: PatchIcon(%s, %s): %w", ErrDecodeFailed, resolvedIcon.Type, resolvedIcon.URL, err)
+		}
+
+		img := image.NewNRGBA(image.Rectangle{Max: size})
+		if frameRes.Image.Bounds().Size() == size {
+			draw.Draw(img, img.Bounds(), frameRes.Image, frameRes.Image.Bounds().Min, draw.Src)
+		} else {
+			draw.CatmullRom.Scale(img, img.Bounds(), frameRes.Image, frameRes.Image.Bounds(), draw.Src, nil)
+		}
+
+		patched.Frames = append(patched.Frames, animation.Frame{Image: img, Delay: frame.Delay})
+	}
+
+	return patched, nil
+}
@@ -0,0 +1,94 @@
+package favicon
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	errRedirectChangedHosts = errors.New("bad redirect")
+	errTooManyRedirects     = errors.New("too many redirects")
+	errRedirectDowngrade    = errors.New("redirect downgrades https to http")
+)
+
+func isRedirectPolicyError(err error) bool {
+	return errors.Is(err, errRedirectChangedHosts) ||
+		errors.Is(err, errTooManyRedirects) ||
+		errors.Is(err, errRedirectDowngrade)
+}
+
+// checkRedirect returns the redirect policy for a single fetch. Cross-site
+// redirects are only followed when allowSiteChange is set, the hop limit and
+// the https downgrade check always apply.
+func (r *Resolver) checkRedirect(allowSiteChange bool) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > r.opts.MaxRedirects {
+			return errTooManyRedirects
+		}
+
+		if via[len(via)-1].URL.Scheme == "https" && req.URL.Scheme == "http" {
+			return errRedirectDowngrade
+		}
+
+		if allowSiteChange {
+			return nil
+		}
+
+		if !sameSite(via[0].URL.Hostname(), req.URL.Hostname()) {
+			return errRedirectChangedHosts
+		}
+
+		return nil
+	}
+}
+
+// sameSite reports whether both hosts share a registrable domain (eTLD+1),
+// which makes example.com, www.example.com and static.example.com equivalent.
+func sameSite(a, b string) bool {
+	a = strings.ToLower(strings.TrimSuffix(a, "."))
+	b = strings.ToLower(strings.TrimSuffix(b, "."))
+
+	if a == b {
+		return true
+	}
+
+	if net.ParseIP(a) != nil || net.ParseIP(b) != nil {
+		return false
+	}
+
+	siteA, errA := publicsuffix.EffectiveTLDPlusOne(a)
+	siteB, errB := publicsuffix.EffectiveTLDPlusOne(b)
+	if errA != nil || errB != nil {
+		// Not under a known suffix (e.g. "localhost"), the www. domain is
+		// still not really another domain in our case.
+		return strings.TrimPrefix(a, "www.") == strings.TrimPrefix(b, "www.")
+	}
+
+	return siteA == siteB
+}
+
+// redirectChain lists every URL that was requested to obtain res, in order,
+// the final URL included.
+func redirectChain(res *http.Response) []string {
+	var chain []string
+
+	for req := res.Request; req != nil; {
+		chain = append(chain, req.URL.String())
+
+		if req.Response == nil {
+			break
+		}
+
+		req = req.Response.Request
+	}
+
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+
+	return chain
+}
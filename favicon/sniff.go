@@ -0,0 +1,274 @@
+package favicon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+type IconType byte
+
+func (i IconType) ContentType() string {
+	switch i {
+	case Ico:
+		return "image/x-icon"
+	case Png:
+		return "image/png"
+	case Jpeg:
+		return "image/jpeg"
+	case Webp:
+		return "image/webp"
+	case Gif:
+		return "image/gif"
+	case Bmp:
+		return "image/bmp"
+	case Cur:
+		return "image/x-win-bitmap"
+	case Svg:
+		return "image/svg+xml"
+	case Avif:
+		return "image/avif"
+	default:
+		panic("should not happen")
+	}
+}
+
+func (i IconType) String() string {
+	switch i {
+	case Ico:
+		return "ico"
+	case Png:
+		return "png"
+	case Jpeg:
+		return "jpeg"
+	case Webp:
+		return "webp"
+	case Gif:
+		return "gif"
+	case Bmp:
+		return "bmp"
+	case Cur:
+		return "cur"
+	case Svg:
+		return "svg"
+	case Avif:
+		return "avif"
+	default:
+		return "unknown"
+	}
+}
+
+// Decodable reports whether image.Decode knows about this format.
+func (i IconType) Decodable() bool {
+	return i != Svg && i != Avif
+}
+
+const (
+	Ico = 1 + iota
+	Png
+	Jpeg
+	Webp
+	Gif
+	Bmp
+	Cur
+	Svg
+	Avif
+)
+
+// sniffLen is how much of a body we look at, enough to find an <svg> tag
+// behind an XML prolog.
+const sniffLen = 512
+
+// SniffError explains why a body was not accepted as an icon.
+type SniffError struct {
+	Reason string
+	// ContentType is the Content-Type header that came with the body, if any.
+	ContentType string
+	// Head holds the first bytes of the body.
+	Head []byte
+}
+
+func (e *SniffError) Error() string {
+	head := e.Head
+	if len(head) > 16 {
+		head = head[:16]
+	}
+
+	return fmt.Sprintf("not an icon: %s (content-type %q, head % x)", e.Reason, e.ContentType, head)
+}
+
+func (e *SniffError) Unwrap() error {
+	return ErrIconNotFound
+}
+
+// sniffIcon reads the beginning of r and decides what kind of image it holds,
+// cross-checking the declared Content-Type. The bytes consumed from r are returned
+// so that the caller can put them back in front of the rest of the body.
+func sniffIcon(r io.Reader, declared string) (IconType, []byte, error) {
+	head := make([]byte, sniffLen)
+
+	n, err := io.ReadFull(r, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, nil, fmt.Errorf("%w: %w", errReadBody, err)
+	}
+
+	head = head[:n]
+
+	iconType, reason := sniffBytes(head, declared)
+	if reason != "" {
+		return 0, head, &SniffError{Reason: reason, ContentType: declared, Head: head}
+	}
+
+	return iconType, head, nil
+}
+
+func sniffBytes(head []byte, declared string) (IconType, string) {
+	if len(head) == 0 {
+		return 0, "empty body"
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(declared)
+	mediaType = strings.ToLower(mediaType)
+
+	iconType, weak := sniffSignature(head)
+	if iconType == 0 {
+		if mediaType != "" && !strings.HasPrefix(mediaType, "image/") {
+			return 0, fmt.Sprintf("%s body without an image signature", mediaType)
+		}
+
+		return 0, "unrecognized signature"
+	}
+
+	// A two bytes signature is not much to go on, an error page that happens to
+	// start with "BM" should not make it through.
+	if weak && (strings.HasPrefix(mediaType, "text/") || mediaType == "application/json") {
+		return 0, fmt.Sprintf("%s body only matching the %s signature", mediaType, iconType)
+	}
+
+	if !iconType.Decodable() {
+		return 0, fmt.Sprintf("unsupported format %s", iconType)
+	}
+
+	return iconType, ""
+}
+
+// SniffType tells what kind of image data holds from its first bytes, 0 when
+// they match no known signature. Unlike LoadIcon, it also recognizes the formats
+// that cannot be decoded.
+func SniffType(data []byte) IconType {
+	iconType, _ := sniffSignature(data[:min(len(data), sniffLen)])
+	return iconType
+}
+
+// sniffSignature matches magic bytes. weak is set for signatures that are
+// too short to be trusted on their own.
+func sniffSignature(head []byte) (iconType IconType, weak bool) {
+	// ico and cur
+	// layout for future reference
+	// 0 0 1 0 @4
+	//     ^^^ image type (1 is icon, 2 is cursor)
+	//        1 0 @6
+	//        ^^^ number of images in a file (2 bytes)
+	//			  16 16 @8 (0 means 256 pixels for each)
+	// 			  ^^^^^ width x height
+	//                  37 @9 (0 means 256 colors)
+	//                  ^^ color count
+	//                     0 @10
+	//                     ^ reserved bit
+	// 					     1 0 @12
+	//						 ^^^ color planes (0 or 1 for icon format, x hotspot for cursors)
+	//    						 1 0 @14
+	//						     ^^^ bits per pixels (y hotspot for cursors)
+	//  						     0 0 0 0 @18
+	//            					 ^^^^^^^ size of the bitmap data in bytes
+	//                                       0 0 0 0 @22
+	// 										 ^^^^^^^ offset in the file
+	if len(head) >= 10 && head[0] == 0 && head[1] == 0 && (head[2] == 1 || head[2] == 2) && head[3] == 0 {
+		count := int(head[4]) | int(head[5])<<8
+		if count > 0 && head[9] == 0 {
+			if head[2] == 2 {
+				return Cur, false
+			}
+
+			return Ico, false
+		}
+	}
+
+	if bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1A\n")) {
+		return Png, false
+	}
+
+	// jpeg: SOI followed by any marker (APP0-APP15, DQT, SOF, COM)
+	if len(head) >= 4 && head[0] == 0xFF && head[1] == 0xD8 && head[2] == 0xFF {
+		marker := head[3]
+		if (marker >= 0xE0 && marker <= 0xEF) || (marker >= 0xC0 && marker <= 0xCF) || marker == 0xDB || marker == 0xFE {
+			return Jpeg, false
+		}
+	}
+
+	if len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP" {
+		return Webp, false
+	}
+
+	if bytes.HasPrefix(head, []byte("GIF87a")) || bytes.HasPrefix(head, []byte("GIF89a")) {
+		return Gif, false
+	}
+
+	if isAVIF(head) {
+		return Avif, false
+	}
+
+	if bytes.HasPrefix(head, []byte("BM")) {
+		return Bmp, true
+	}
+
+	if isSVG(head) {
+		return Svg, false
+	}
+
+	return 0, false
+}
+
+// isAVIF looks for an ISO BMFF ftyp box listing an AVIF brand.
+func isAVIF(head []byte) bool {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return false
+	}
+
+	boxSize := int(head[0])<<24 | int(head[1])<<16 | int(head[2])<<8 | int(head[3])
+	if boxSize < 16 || boxSize > len(head) {
+		boxSize = len(head)
+	}
+
+	// major brand, minor version, then compatible brands
+	for offset := 8; offset+4 <= boxSize; offset += 4 {
+		if offset == 12 {
+			continue
+		}
+
+		brand := string(head[offset : offset+4])
+		if brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isSVG(head []byte) bool {
+	head = bytes.TrimPrefix(head, []byte("\xEF\xBB\xBF"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+
+	if bytes.HasPrefix(head, []byte("<svg")) {
+		return true
+	}
+
+	if bytes.HasPrefix(head, []byte("<?xml")) || bytes.HasPrefix(head, []byte("<!--")) || bytes.HasPrefix(head, []byte("<!DOCTYPE svg")) {
+		return bytes.Contains(head, []byte("<svg"))
+	}
+
+	return false
+}
@@ -0,0 +1,283 @@
+package favicon
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"faviconapi/iconhash"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Options struct {
+	// Timeout applies to a single outbound request, redirects included.
+	Timeout time.Duration
+	// MaxRedirects is the number of hops followed before giving up.
+	MaxRedirects int
+	// MaxIconSize is the largest icon file we are willing to download, in bytes.
+	MaxIconSize int64
+
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+
+	// ProxyURL may be an http://, https:// or socks5:// URL. When empty, the
+	// standard HTTP_PROXY / HTTPS_PROXY / NO_PROXY variables are honored.
+	ProxyURL string
+
+	// DNSServer is a host:port used instead of the system resolver.
+	DNSServer string
+
+	DisableHTTP2 bool
+
+	TLSMinVersion         uint16
+	TLSInsecureSkipVerify bool
+	// TLSRootCAFile is a PEM bundle added to the system roots, useful when
+	// egress goes through an intercepting proxy.
+	TLSRootCAFile string
+
+	// PlaceholderBlocklist is the path of an iconhash blocklist added to the
+	// built-in one, icons matching either are treated as not found.
+	PlaceholderBlocklist string
+	// SkipBlocklist accepts the icons matching a placeholder blocklist, for
+	// the tools describing them.
+	SkipBlocklist bool
+
+	// WrapTransport, when set, wraps the transport of every outbound request,
+	// to instrument them for instance.
+	WrapTransport func(http.RoundTripper) http.RoundTripper
+}
+
+var DefaultOptions = Options{
+	Timeout:             5 * time.Second,
+	MaxRedirects:        5,
+	MaxIconSize:         8 << 20,
+	MaxIdleConns:        512,
+	MaxIdleConnsPerHost: 4,
+	MaxConnsPerHost:     8,
+	IdleConnTimeout:     90 * time.Second,
+	TLSMinVersion:       tls.VersionTLS12,
+}
+
+// OptionsFromEnv reads the OUTBOUND_* variables on top of DefaultOptions.
+func OptionsFromEnv() (Options, error) {
+	opts := DefaultOptions
+
+	var err error
+	intVars := map[string]*int{
+		"OUTBOUND_MAX_REDIRECTS":           &opts.MaxRedirects,
+		"OUTBOUND_MAX_IDLE_CONNS":          &opts.MaxIdleConns,
+		"OUTBOUND_MAX_IDLE_CONNS_PER_HOST": &opts.MaxIdleConnsPerHost,
+		"OUTBOUND_MAX_CONNS_PER_HOST":      &opts.MaxConnsPerHost,
+	}
+	for name, dst := range intVars {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+
+		*dst, err = strconv.Atoi(v)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	durationVars := map[string]*time.Duration{
+		"OUTBOUND_TIMEOUT":           &opts.Timeout,
+		"OUTBOUND_IDLE_CONN_TIMEOUT": &opts.IdleConnTimeout,
+	}
+	for name, dst := range durationVars {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+
+		*dst, err = time.ParseDuration(v)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	boolVars := map[string]*bool{
+		"OUTBOUND_DISABLE_HTTP2": &opts.DisableHTTP2,
+		"OUTBOUND_TLS_INSECURE":  &opts.TLSInsecureSkipVerify,
+	}
+	for name, dst := range boolVars {
+		v := os.Getenv(name)
+		if v == "" {
+			continue
+		}
+
+		*dst, err = strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	if v := os.Getenv("OUTBOUND_TLS_MIN_VERSION"); v != "" {
+		switch v {
+		case "1.0":
+			opts.TLSMinVersion = tls.VersionTLS10
+		case "1.1":
+			opts.TLSMinVersion = tls.VersionTLS11
+		case "1.2":
+			opts.TLSMinVersion = tls.VersionTLS12
+		case "1.3":
+			opts.TLSMinVersion = tls.VersionTLS13
+		default:
+			return opts, fmt.Errorf("OUTBOUND_TLS_MIN_VERSION: unknown version %q", v)
+		}
+	}
+
+	opts.ProxyURL = os.Getenv("OUTBOUND_PROXY")
+	opts.DNSServer = os.Getenv("OUTBOUND_DNS_SERVER")
+	opts.TLSRootCAFile = os.Getenv("OUTBOUND_CA_FILE")
+	opts.PlaceholderBlocklist = os.Getenv("PLACEHOLDER_BLOCKLIST")
+
+	if v := os.Getenv("MAX_ICON_SIZE"); v != "" {
+		opts.MaxIconSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("MAX_ICON_SIZE: %w", err)
+		}
+	}
+
+	return opts, nil
+}
+
+// Resolver finds and downloads icons. It owns a single transport shared
+// by every outbound request so that connections are pooled across resolutions.
+type Resolver struct {
+	opts      Options
+	transport *http.Transport
+	// roundTripper is what requests go through, transport unless
+	// Options.WrapTransport is set.
+	roundTripper http.RoundTripper
+	blocklist    *iconhash.Blocklist
+}
+
+func NewResolver(opts Options) (*Resolver, error) {
+	transport, err := newTransport(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if opts.WrapTransport != nil {
+		roundTripper = opts.WrapTransport(transport)
+	}
+
+	var blocklist *iconhash.Blocklist
+	if !opts.SkipBlocklist {
+		blocklist = iconhash.DefaultBlocklist()
+	}
+
+	if blocklist != nil && opts.PlaceholderBlocklist != "" {
+		extra, err := iconhash.LoadBlocklist(opts.PlaceholderBlocklist)
+		if err != nil {
+			return nil, fmt.Errorf("placeholder blocklist: %w", err)
+		}
+
+		blocklist.Entries = append(blocklist.Entries, extra.Entries...)
+	}
+
+	return &Resolver{
+		opts:         opts,
+		transport:    transport,
+		roundTripper: roundTripper,
+		blocklist:    blocklist,
+	}, nil
+}
+
+// CloseIdleConnections releases pooled connections, see http.Transport.CloseIdleConnections.
+func (r *Resolver) CloseIdleConnections() {
+	r.transport.CloseIdleConnections()
+}
+
+func newTransport(opts Options) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   opts.Timeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if opts.DNSServer != "" {
+		if _, _, err := net.SplitHostPort(opts.DNSServer); err != nil {
+			return nil, fmt.Errorf("dns server %q: %w", opts.DNSServer, err)
+		}
+
+		dnsServer := opts.DNSServer
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: opts.Timeout}
+				return d.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         opts.TLSMinVersion,
+		InsecureSkipVerify: opts.TLSInsecureSkipVerify,
+	}
+
+	if opts.TLSRootCAFile != "" {
+		pem, err := os.ReadFile(opts.TLSRootCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", opts.TLSRootCAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy url: %w", err)
+		}
+
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, errors.New("proxy url: scheme must be one of http, https, socks5 or socks5h")
+		}
+
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     !opts.DisableHTTP2,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.Timeout,
+		ResponseHeaderTimeout: opts.Timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	if opts.DisableHTTP2 {
+		// A non-nil, empty map is the documented way to turn HTTP/2 off.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport, nil
+}
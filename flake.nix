@@ -18,7 +18,7 @@
               CGO_ENABLED = 0;
 
               ldflags = [ "-X faviconapi/defaults.CacheStatus=enabled" ];
-                  vendorHash = "sha256-Bs1Ni2r8Fs3LVfYFRT85dwttVYZpCQBeQkbl4ta6Ug8=";
+                  vendorHash = "sha256-FJf5G0xvCwG6POVDb1uPrCpLkZBeO3f0zTpbrl3mQ4c=";
                   src = ./.;
               };
 
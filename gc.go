@@ -0,0 +1,554 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// orphanGrace is how old unreferenced blobs and access objects must be to be
+// deleted, a wide margin for the entries stored while the bucket is listed.
+const orphanGrace = 30 * 24 * time.Hour
+
+// entryKeyPattern takes the host back from the keys made by iconObjectKey,
+// avatarObjectKey and darkObjectKey, for legacy entries and those older than
+// the host metadata.
+var entryKeyPattern = regexp.MustCompile(`^(?:entries|favicons)/(.+?)(\.[0-9a-f]{12})?(\.avatar)?(\.dark(-[0-9a-f]{6})?)?\.(png|gif|webp)$`)
+
+type storedObject struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// storedEntry is a host entry under entries/, along with its metadata, or a
+// legacy one under favicons/.
+type storedEntry struct {
+	storedObject
+	Host string
+	Meta map[string]string
+}
+
+type storageInventory struct {
+	Entries []storedEntry
+	// Legacy holds the entries stored with the icon, before they pointed to
+	// blobs. Their metadata is not read.
+	Legacy []storedEntry
+	Blobs  []storedObject
+	Index  []storedObject
+	// Access holds the last access time of hosts, see recordAccess.
+	Access map[string]storedObject
+	Other  []storedObject
+}
+
+// scanStorage lists the whole bucket and reads the metadata of every host
+// entry, concurrency of them at a time.
+func scanStorage(ctx Context, concurrency int) (*storageInventory, error) {
+	inv := &storageInventory{Access: map[string]storedObject{}}
+
+	paginator := s3.NewListObjectsV2Paginator(ctx.s3, &s3.ListObjectsV2Input{Bucket: &s3Bucket})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx.requestContext())
+		if err != nil {
+			return nil, storageError(err)
+		}
+
+		for _, object := range page.Contents {
+			stored := storedObject{
+				Key:      aws.ToString(object.Key),
+				Size:     aws.ToInt64(object.Size),
+				Modified: aws.ToTime(object.LastModified),
+			}
+
+			switch {
+			case strings.HasPrefix(stored.Key, "entries/"):
+				inv.Entries = append(inv.Entries, storedEntry{storedObject: stored})
+			case strings.HasPrefix(stored.Key, "favicons/"):
+				legacy := storedEntry{storedObject: stored}
+				if m := entryKeyPattern.FindStringSubmatch(stored.Key); m != nil {
+					legacy.Host = m[1]
+				}
+				inv.Legacy = append(inv.Legacy, legacy)
+			case strings.HasPrefix(stored.Key, "blobs/"):
+				inv.Blobs = append(inv.Blobs, stored)
+			case strings.HasPrefix(stored.Key, "index/"):
+				inv.Index = append(inv.Index, stored)
+			case strings.HasPrefix(stored.Key, "access/"):
+				inv.Access[strings.TrimPrefix(stored.Key, "access/")] = stored
+			default:
+				inv.Other = append(inv.Other, stored)
+			}
+		}
+	}
+
+	queue := make(chan *storedEntry)
+	wg := &sync.WaitGroup{}
+	errs := make([]error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for entry := range queue {
+				head, err := ctx.s3.HeadObject(ctx.requestContext(), &s3.HeadObjectInput{
+					Bucket: &s3Bucket,
+					Key:    &entry.Key,
+				})
+				// Deleted since it was listed, it has no metadata and is
+				// treated as stale.
+				if err != nil && !isNotFound(err) {
+					errs[i] = storageError(err)
+					continue
+				}
+
+				if head != nil {
+					entry.Meta = head.Metadata
+				}
+
+				entry.Host = entry.Meta["host"]
+				if entry.Host == "" {
+					if m := entryKeyPattern.FindStringSubmatch(entry.Key); m != nil {
+						entry.Host = m[1]
+					}
+				}
+			}
+		}(i)
+	}
+
+	for i := range inv.Entries {
+		queue <- &inv.Entries[i]
+	}
+
+	close(queue)
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return inv, nil
+}
+
+// lastAccess is the last time the icon of host was requested, or when the
+// entry was written if that is more recent or access was not recorded yet.
+func (inv *storageInventory) lastAccess(entry storedEntry) time.Time {
+	access, ok := inv.Access[entry.Host]
+	if !ok || access.Modified.Before(entry.Modified) {
+		return entry.Modified
+	}
+
+	return access.Modified
+}
+
+// runInventory prints what the bucket holds.
+//
+//	faviconapi inventory [-list]
+func runInventory(args []string) error {
+	fs := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	list := fs.Bool("list", false, "list every host entry with its version and last access")
+	concurrency := fs.Int("concurrency", 16, "number of entries whose metadata is read at the same time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	ctx, err := newContext()
+	if err != nil {
+		return err
+	}
+
+	inv, err := scanStorage(ctx, *concurrency)
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		for _, entry := range inv.Entries {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.Key, versionOf(entry), entry.Modified.Format(time.RFC3339), inv.lastAccess(entry).Format(time.RFC3339))
+		}
+
+		for _, entry := range inv.Legacy {
+			fmt.Printf("%s\t%s\t%s\t%s\n", entry.Key, "legacy", entry.Modified.Format(time.RFC3339), inv.lastAccess(entry).Format(time.RFC3339))
+		}
+
+		fmt.Println()
+	}
+
+	inv.print(os.Stdout, time.Now())
+
+	return nil
+}
+
+func versionOf(entry storedEntry) string {
+	if v := entry.Meta["version"]; v != "" {
+		return v
+	}
+
+	return "none"
+}
+
+func (inv *storageInventory) print(w io.Writer, now time.Time) {
+	var access []storedObject
+	for _, object := range inv.Access {
+		access = append(access, object)
+	}
+
+	entries := make([]storedObject, 0, len(inv.Entries))
+	for _, entry := range inv.Entries {
+		entries = append(entries, entry.storedObject)
+	}
+
+	legacy := make([]storedObject, 0, len(inv.Legacy))
+	for _, entry := range inv.Legacy {
+		legacy = append(legacy, entry.storedObject)
+	}
+
+	fmt.Fprintln(w, "objects:")
+	for _, kind := range []struct {
+		name    string
+		objects []storedObject
+	}{
+		{"entries", entries},
+		{"legacy", legacy},
+		{"blobs", inv.Blobs},
+		{"index", inv.Index},
+		{"access", access},
+		{"other", inv.Other},
+	} {
+		fmt.Fprintf(w, "  %-12s %8d %12s\n", kind.name, len(kind.objects), formatBytes(totalSize(kind.objects)))
+	}
+
+	versions := map[string]int{}
+	for _, entry := range inv.Entries {
+		versions[versionOf(entry)]++
+	}
+
+	names := make([]string, 0, len(versions))
+	for v := range versions {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "entries by version:")
+	for _, v := range names {
+		current := ""
+		if v == Version {
+			current = " (current)"
+		}
+
+		fmt.Fprintf(w, "  %-12s %8d%s\n", v, versions[v], current)
+	}
+
+	limits := []int64{1 << 10, 10 << 10, 100 << 10}
+	counts := make([]int, len(limits)+1)
+	totals := make([]int64, len(limits)+1)
+	for _, blob := range inv.Blobs {
+		i := sort.Search(len(limits), func(i int) bool { return blob.Size < limits[i] })
+		counts[i]++
+		totals[i] += blob.Size
+	}
+
+	fmt.Fprintln(w, "blobs by size:")
+	for i := range counts {
+		var label string
+		if i < len(limits) {
+			label = "< " + formatBytes(limits[i])
+		} else {
+			label = ">= " + formatBytes(limits[i-1])
+		}
+
+		fmt.Fprintf(w, "  %-12s %8d %12s\n", label, counts[i], formatBytes(totals[i]))
+	}
+
+	ages := []struct {
+		label string
+		age   time.Duration
+	}{
+		{"< 1 day", 24 * time.Hour},
+		{"< 7 days", 7 * 24 * time.Hour},
+		{"< 30 days", 30 * 24 * time.Hour},
+		{"< 90 days", 90 * 24 * time.Hour},
+		{"older", 0},
+	}
+
+	written := make([]int, len(ages))
+	accessed := make([]int, len(ages))
+	bucket := func(t time.Time) int {
+		for i, a := range ages[:len(ages)-1] {
+			if now.Sub(t) < a.age {
+				return i
+			}
+		}
+
+		return len(ages) - 1
+	}
+
+	for _, entry := range inv.Entries {
+		written[bucket(entry.Modified)]++
+		accessed[bucket(inv.lastAccess(entry))]++
+	}
+
+	fmt.Fprintf(w, "entries by age: %8s %8s\n", "written", "accessed")
+	for i, a := range ages {
+		fmt.Fprintf(w, "  %-14s %8d %8d\n", a.label, written[i], accessed[i])
+	}
+}
+
+func totalSize(objects []storedObject) int64 {
+	var total int64
+	for _, object := range objects {
+		total += object.Size
+	}
+
+	return total
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+type gcOptions struct {
+	// Stale deletes the entries made by a Version older than this one.
+	Stale bool
+	// UnusedFor deletes the entries of hosts not requested for that long, 0
+	// keeps them.
+	UnusedFor time.Duration
+}
+
+type gcDeletion struct {
+	storedObject
+	Reason string
+}
+
+// planGC decides what to delete. Entries are deleted for being stale or
+// unused, then whatever no remaining entry refers to: index objects right away
+// since nothing reads them for missing entries, blobs and access objects once
+// older than orphanGrace. Legacy entries are only deleted for being unused,
+// links to them may have been handed out before the current Version; they do
+// not keep index objects, the hosts sharing an icon are those of the entries.
+func planGC(inv *storageInventory, opts gcOptions, now time.Time) []gcDeletion {
+	var deletions []gcDeletion
+
+	keptHosts := map[string]bool{}
+	keptBlobs := map[string]bool{}
+	keptIndex := map[string]bool{}
+
+	for _, entry := range inv.Entries {
+		switch {
+		case opts.Stale && staleVersion(entry.Meta["version"]):
+			deletions = append(deletions, gcDeletion{entry.storedObject, "stale version"})
+		case opts.UnusedFor > 0 && now.Sub(inv.lastAccess(entry)) > opts.UnusedFor:
+			deletions = append(deletions, gcDeletion{entry.storedObject, "unused"})
+		default:
+			keptHosts[entry.Host] = true
+			keptBlobs[entry.Meta["blob"]] = true
+			if digest := entry.Meta["sha256"]; digest != "" {
+				keptIndex[indexKey(digest, entry.Host)] = true
+			}
+		}
+	}
+
+	for _, entry := range inv.Legacy {
+		if opts.UnusedFor > 0 && now.Sub(inv.lastAccess(entry)) > opts.UnusedFor {
+			deletions = append(deletions, gcDeletion{entry.storedObject, "unused legacy"})
+		} else {
+			keptHosts[entry.Host] = true
+		}
+	}
+
+	for _, object := range inv.Index {
+		// Entries are listed before their index objects, one written in
+		// between is missed: recent index objects are left alone.
+		if !keptIndex[object.Key] && now.Sub(object.Modified) > 24*time.Hour {
+			deletions = append(deletions, gcDeletion{object, "dangling index"})
+		}
+	}
+
+	for _, object := range inv.Blobs {
+		if !keptBlobs[object.Key] && now.Sub(object.Modified) > orphanGrace {
+			deletions = append(deletions, gcDeletion{object, "orphaned blob"})
+		}
+	}
+
+	for host, object := range inv.Access {
+		if !keptHosts[host] && now.Sub(object.Modified) > orphanGrace {
+			deletions = append(deletions, gcDeletion{object, "orphaned access"})
+		}
+	}
+
+	return deletions
+}
+
+// staleVersion tells whether an entry made by version predates Version. During
+// a rolling deploy the instances still running the previous Version write its
+// entries, and those of the next one must survive a gc run from an old binary:
+// newer and unknown versions are never stale. Entries without a version
+// predate versioned metadata.
+func staleVersion(version string) bool {
+	if version == "" {
+		return true
+	}
+
+	n, err := strconv.Atoi(version)
+	if err != nil {
+		return false
+	}
+
+	current, err := strconv.Atoi(Version)
+	if err != nil {
+		return false
+	}
+
+	return n < current
+}
+
+// runGC deletes stale and unused entries along with the objects only they
+// referred to.
+//
+//	faviconapi gc [-dry-run] [-stale=true] [-unused-days 180]
+func runGC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "list what would be deleted without deleting anything")
+	stale := fs.Bool("stale", true, "delete the entries made by older versions")
+	unusedDays := fs.Int("unused-days", 0, "delete the entries of hosts not requested for this many days, at least 31, 0 keeps them")
+	concurrency := fs.Int("concurrency", 16, "number of entries whose metadata is read at the same time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	if *unusedDays < 0 {
+		return errors.New("unused-days must be positive")
+	}
+
+	// Instances serve the entries in their memory cache without looking them
+	// up in storage, for up to cacheLifetime after the access recorded last:
+	// an entry deleted sooner would still be linked to.
+	unusedFor := time.Duration(*unusedDays) * 24 * time.Hour
+	minUnusedFor := cacheLifetime + accessInterval
+	if unusedFor > 0 && unusedFor < minUnusedFor {
+		return fmt.Errorf("unused-days must be at least %d, entries stay in the memory cache of instances for that long", minUnusedFor/(24*time.Hour))
+	}
+
+	ctx, err := newContext()
+	if err != nil {
+		return err
+	}
+
+	inv, err := scanStorage(ctx, *concurrency)
+	if err != nil {
+		return err
+	}
+
+	deletions := planGC(inv, gcOptions{
+		Stale:     *stale,
+		UnusedFor: unusedFor,
+	}, time.Now())
+
+	if *dryRun {
+		for _, deletion := range deletions {
+			fmt.Printf("would delete %s (%s)\n", deletion.Key, deletion.Reason)
+		}
+
+		printGCSummary("would delete", deletions)
+
+		return nil
+	}
+
+	deleted, err := deleteObjects(ctx, deletions)
+	printGCSummary("deleted", deleted)
+
+	return err
+}
+
+// printGCSummary prints the number and size of the deletions by reason.
+func printGCSummary(verb string, deletions []gcDeletion) {
+	counts := map[string]int{}
+	sizes := map[string]int64{}
+	for _, deletion := range deletions {
+		counts[deletion.Reason]++
+		sizes[deletion.Reason] += deletion.Size
+	}
+
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	fmt.Printf("%s %d objects\n", verb, len(deletions))
+	for _, reason := range reasons {
+		fmt.Printf("  %-16s %8d %12s\n", reason, counts[reason], formatBytes(sizes[reason]))
+	}
+}
+
+// deleteObjects deletes in batches of 1000, the most DeleteObjects accepts, and
+// returns the deletions that went through. It stops at the first batch that
+// fails as a whole.
+func deleteObjects(ctx Context, deletions []gcDeletion) ([]gcDeletion, error) {
+	var deleted []gcDeletion
+	var errs []error
+
+	for start := 0; start < len(deletions); start += 1000 {
+		batch := deletions[start:min(start+1000, len(deletions))]
+
+		objects := make([]types.ObjectIdentifier, 0, len(batch))
+		for _, deletion := range batch {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(deletion.Key)})
+		}
+
+		out, err := ctx.s3.DeleteObjects(ctx.requestContext(), &s3.DeleteObjectsInput{
+			Bucket: &s3Bucket,
+			Delete: &types.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return deleted, storageError(err)
+		}
+
+		failed := map[string]bool{}
+		for _, e := range out.Errors {
+			failed[aws.ToString(e.Key)] = true
+			errs = append(errs, fmt.Errorf("%s: %s", aws.ToString(e.Key), aws.ToString(e.Message)))
+		}
+
+		for _, deletion := range batch {
+			if !failed[deletion.Key] {
+				deleted = append(deleted, deletion)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return deleted, storageError(errors.Join(errs...))
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"faviconapi/favicon"
+	"faviconapi/iconpatch"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func writeJSON(rw http.ResponseWriter, res HttpResponse) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(res.Status)
+	_ = json.NewEncoder(rw).Encode(res)
+}
+
+// HealthzEndpoint answers as long as the process serves requests.
+func HealthzEndpoint(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, HttpResponse{Success: true, Status: http.StatusOK, Value: "ok"})
+}
+
+// ReadyzEndpoint checks the configuration and that the bucket can be listed.
+// Failed checks make it answer 503, with the reason of each.
+func ReadyzEndpoint(ctx Context) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{"config": "ok", "storage": "ok"}
+		res := HttpResponse{Success: true, Status: http.StatusOK, Value: checks}
+
+		if err := checkConfig(); err != nil {
+			checks["config"] = err.Error()
+			res.Success = false
+		}
+
+		storageCtx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		_, err := ctx.s3.ListObjectsV2(storageCtx, &s3.ListObjectsV2Input{
+			Bucket:  &s3Bucket,
+			MaxKeys: aws.Int32(1),
+		})
+		if err != nil {
+			checks["storage"] = err.Error()
+			res.Success = false
+		}
+
+		if !res.Success {
+			res.Status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(rw, res)
+	}
+}
+
+func checkConfig() error {
+	if s3Bucket == "" {
+		return errors.New("AWS_BUCKET is empty")
+	}
+
+	if cdnHostForBucket == "" {
+		return errors.New("ASSET_URL_FOR_BUCKET is empty")
+	}
+
+	if strings.Contains(cdnHostForBucket, "://") {
+		return errors.New("ASSET_URL_FOR_BUCKET must be a host, optionally followed by a path")
+	}
+
+	return nil
+}
+
+//go:embed fixtures/site
+var fixtureSite embed.FS
+
+// selftestHost is the host the self-test icon is indexed under.
+const selftestHost = "selftest.invalid"
+
+type SelftestStep struct {
+	Name       string  `json:"name"`
+	OK         bool    `json:"ok"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// isAdmin checks the bearer token of r against ADMIN_TOKEN. Admin endpoints
+// are disabled when it is not set.
+func isAdmin(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// SelftestEndpoint resolves a fixture site served on a loopback port, processes
+// its icon and writes it to the configured storage, reading it back and deleting
+// it afterwards along with its index object and memory cache entry. The
+// content-addressed blob of the fixture icon is kept.
+func SelftestEndpoint(ctx Context, rw http.ResponseWriter, r *http.Request) HttpResponse {
+	if !isAdmin(r) {
+		return HttpResponse{
+			Status: errorStatuses[CodeUnauthorized].Status,
+			Value:  errorStatuses[CodeUnauthorized].Message,
+			Error:  CodeUnauthorized,
+		}
+	}
+
+	var steps []SelftestStep
+	ok := true
+
+	run := func(name string, f func() error) {
+		if !ok {
+			return
+		}
+
+		start := time.Now()
+		err := f()
+
+		step := SelftestStep{Name: name, OK: err == nil, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			step.Error = err.Error()
+			ok = false
+		}
+
+		steps = append(steps, step)
+	}
+
+	var siteURL *url.URL
+	var shutdown func()
+
+	run("serve fixture site", func() (err error) {
+		siteURL, shutdown, err = serveFixtureSite()
+		return err
+	})
+	if shutdown != nil {
+		defer shutdown()
+	}
+
+	var resolvedIcon *favicon.ResolvedIcon
+	run("find icon", func() error {
+		resolver, err := selftestResolver()
+		if err != nil {
+			return err
+		}
+		defer resolver.CloseIdleConnections()
+
+		resolvedIcon, err = resolver.FindFaviconURL(ctx.requestContext(), siteURL)
+		return err
+	})
+
+	var patched *favicon.PatchedIcon
+	run("patch icon", func() (err error) {
+		patched, err = favicon.PatchIcon(resolvedIcon, iconpatch.DefaultPipeline, favicon.AnimationFirst)
+		return err
+	})
+
+	key := "selftest/" + ctx.requestID + ".png"
+	req := ResolveRequest{URL: siteURL, Pipeline: iconpatch.DefaultPipeline, Animation: favicon.AnimationFirst}
+
+	var meta map[string]string
+	run("store icon", func() error {
+		meta = iconMeta(req, resolvedIcon, patched)
+		return storeIcon(ctx, selftestHost, key, patched, meta)
+	})
+
+	run("read icon back", func() error {
+		_, found, err := headIcon(ctx, key)
+		if err == nil && !found {
+			err = errors.New("stored icon not found")
+		}
+
+		return err
+	})
+
+	run("delete icon", func() error {
+		ctx.cache.Delete(iconCacheKey(key))
+
+		for _, k := range []string{key, indexKey(meta["sha256"], selftestHost)} {
+			_, err := ctx.s3.DeleteObject(ctx.requestContext(), &s3.DeleteObjectInput{
+				Bucket: &s3Bucket,
+				Key:    aws.String(k),
+			})
+			if err != nil {
+				return storageError(err)
+			}
+		}
+
+		return nil
+	})
+
+	res := HttpResponse{Success: ok, Status: http.StatusOK, Value: steps}
+	if !ok {
+		res.Status = http.StatusServiceUnavailable
+	}
+
+	return res
+}
+
+// selftestResolver returns a resolver for the fixture site, without
+// OUTBOUND_PROXY: the proxy is there for the sites on the internet, it would
+// not reach the loopback interface of this instance.
+func selftestResolver() (*favicon.Resolver, error) {
+	opts, err := favicon.OptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	opts.ProxyURL = ""
+
+	return favicon.NewResolver(opts)
+}
+
+// serveFixtureSite serves fixtures/site on a loopback port until shutdown is called.
+func serveFixtureSite() (*url.URL, func(), error) {
+	site, err := fs.Sub(fixtureSite, "fixtures/site")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	server := &http.Server{Handler: http.FileServer(http.FS(site)), ReadHeaderTimeout: 5 * time.Second}
+	go func() { _ = server.Serve(listener) }()
+
+	siteURL, err := url.Parse(fmt.Sprintf("http://%s/", listener.Addr()))
+	if err != nil {
+		_ = server.Close()
+		return nil, nil, err
+	}
+
+	return siteURL, func() { _ = server.Close() }, nil
+}
@@ -80,6 +80,43 @@ func ParseIco(r io.Reader) (*icondir, error) {
 	return &dir, err
 }
 
+// Frame describes one of the images stored in an icon.
+type Frame struct {
+	Width        int
+	Height       int
+	BitsPerPixel int
+	// Size is the length of the image data in bytes.
+	Size int
+	// PNG is set for frames stored as PNG rather than as a bitmap.
+	PNG bool
+}
+
+// Frames lists the images of the icon, in the order they are stored.
+func Frames(icoBytes []byte) ([]Frame, error) {
+	dir, err := ParseIco(bytes.NewReader(icoBytes))
+	if err != nil {
+		return nil, errInvalid
+	}
+
+	frames := make([]Frame, 0, len(dir.Entries))
+	for _, e := range dir.Entries {
+		frame := Frame{
+			Width:        e.width(),
+			Height:       e.height(),
+			BitsPerPixel: int(e.BitsPerPixel),
+			Size:         int(e.Size),
+		}
+
+		if int(e.Offset)+len(pngHeader) <= len(icoBytes) {
+			frame.PNG = string(icoBytes[e.Offset:int(e.Offset)+len(pngHeader)]) == pngHeader
+		}
+
+		frames = append(frames, frame)
+	}
+
+	return frames, nil
+}
+
 func parseIcondirEntry(r io.Reader, e *icondirEntry) error {
 	err := binary.Read(r, binary.LittleEndian, e)
 	if err != nil {
@@ -258,6 +295,13 @@ func makeFullBMPBytes(entry *icondirEntry, icoBytes []byte) (*bytes.Buffer, erro
 
 const icoHeader = "\x00\x00\x01\x00"
 
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// Cursors share the icon layout, only the planes and bit count fields of
+// their entries hold the hotspot instead.
+const curHeader = "\x00\x00\x02\x00"
+
 func init() {
 	image.RegisterFormat("ico", icoHeader, Decode, DecodeConfig)
+	image.RegisterFormat("cur", curHeader, Decode, DecodeConfig)
 }
@@ -0,0 +1,101 @@
+package iconhash
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultMaxDistance tolerates the small differences introduced by
+// re-encoding or resizing an icon.
+const DefaultMaxDistance = 4
+
+type Entry struct {
+	Hash Hash
+	Name string
+}
+
+// Blocklist holds the hashes of icons that should never be served, such as
+// the default icons of web servers, hosting providers and CMSes.
+//
+// The file format is one entry per line, a hexadecimal hash followed by an
+// optional name. Blank lines and lines starting with # are ignored:
+//
+//	# nginx welcome page
+//	f0e4c2c2c4e8f0f0 nginx
+type Blocklist struct {
+	Entries     []Entry
+	MaxDistance int
+}
+
+//go:embed placeholders.txt
+var defaultPlaceholders string
+
+// DefaultBlocklist returns the built-in list of default icons, placeholders.txt.
+func DefaultBlocklist() *Blocklist {
+	list, err := ParseBlocklist(strings.NewReader(defaultPlaceholders))
+	if err != nil {
+		panic("iconhash: placeholders.txt: " + err.Error())
+	}
+
+	return list
+}
+
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseBlocklist(f)
+}
+
+func ParseBlocklist(r io.Reader) (*Blocklist, error) {
+	list := &Blocklist{MaxDistance: DefaultMaxDistance}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		hashField, name, _ := strings.Cut(text, " ")
+
+		hash, err := ParseHash(hashField)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		list.Entries = append(list.Entries, Entry{Hash: hash, Name: strings.TrimSpace(name)})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Match returns the closest entry within MaxDistance of hash.
+func (b *Blocklist) Match(hash Hash) (Entry, bool) {
+	if b == nil {
+		return Entry{}, false
+	}
+
+	best, bestDistance := Entry{}, b.MaxDistance+1
+	for _, entry := range b.Entries {
+		if d := Distance(hash, entry.Hash); d < bestDistance {
+			best, bestDistance = entry, d
+		}
+	}
+
+	return best, bestDistance <= b.MaxDistance
+}
@@ -0,0 +1,58 @@
+// Package iconhash computes perceptual hashes of icons, so that visually
+// identical icons can be recognized regardless of their encoding or size.
+package iconhash
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Hash is a 64 bits difference hash (dHash).
+type Hash uint64
+
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+func ParseHash(s string) (Hash, error) {
+	v, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("iconhash: invalid hash %q", s)
+	}
+
+	return Hash(v), nil
+}
+
+// Distance is the number of differing bits between two hashes, 0 meaning
+// the icons look the same.
+func Distance(a, b Hash) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// DHash scales img down to 9x8 over a white background and sets one bit
+// per pixel that is brighter than its right neighbour.
+func DHash(img image.Image) Hash {
+	small := image.NewNRGBA(image.Rect(0, 0, 9, 8))
+	draw.Draw(small, small.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(small, small.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var hash Hash
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.NRGBAAt(x, y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.NRGBAAt(x+1, y)).(color.Gray).Y
+
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
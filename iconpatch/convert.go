@@ -0,0 +1,85 @@
+package iconpatch
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// ToNRGBA returns a copy of icon as an *image.NRGBA whose bounds start at (0, 0).
+// The image types produced by the decoders we use are converted by working on
+// their Pix slices directly, anything else goes through image/draw.
+func ToNRGBA(icon image.Image) *image.NRGBA {
+	bounds := icon.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+
+	switch src := icon.(type) {
+	case *image.NRGBA:
+		for y := 0; y < h; y++ {
+			i := src.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			copy(img.Pix[y*img.Stride:y*img.Stride+w*4], src.Pix[i:i+w*4])
+		}
+	case *image.RGBA:
+		for y := 0; y < h; y++ {
+			i := src.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			s := src.Pix[i : i+w*4 : i+w*4]
+			d := img.Pix[y*img.Stride : y*img.Stride+w*4 : y*img.Stride+w*4]
+			for x := 0; x < len(s); x += 4 {
+				a := s[x+3]
+				switch a {
+				case 0:
+					d[x], d[x+1], d[x+2], d[x+3] = 0, 0, 0, 0
+				case 255:
+					d[x], d[x+1], d[x+2], d[x+3] = s[x], s[x+1], s[x+2], 255
+				default:
+					d[x] = unpremultiply(s[x], a)
+					d[x+1] = unpremultiply(s[x+1], a)
+					d[x+2] = unpremultiply(s[x+2], a)
+					d[x+3] = a
+				}
+			}
+		}
+	case *image.Paletted:
+		var palette [256][4]uint8
+		for i, c := range src.Palette {
+			if i >= len(palette) {
+				break
+			}
+
+			nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+			palette[i] = [4]uint8{nc.R, nc.G, nc.B, nc.A}
+		}
+
+		for y := 0; y < h; y++ {
+			i := src.PixOffset(bounds.Min.X, bounds.Min.Y+y)
+			s := src.Pix[i : i+w : i+w]
+			d := img.Pix[y*img.Stride : y*img.Stride+w*4 : y*img.Stride+w*4]
+			for x, index := range s {
+				copy(d[x*4:x*4+4], palette[index][:])
+			}
+		}
+	case *image.YCbCr:
+		for y := 0; y < h; y++ {
+			d := img.Pix[y*img.Stride : y*img.Stride+w*4 : y*img.Stride+w*4]
+			for x := 0; x < w; x++ {
+				yi := src.YOffset(bounds.Min.X+x, bounds.Min.Y+y)
+				ci := src.COffset(bounds.Min.X+x, bounds.Min.Y+y)
+				r, g, b := color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+				d[x*4], d[x*4+1], d[x*4+2], d[x*4+3] = r, g, b, 255
+			}
+		}
+	default:
+		draw.Draw(img, img.Bounds(), icon, bounds.Min, draw.Src)
+	}
+
+	return img
+}
+
+func unpremultiply(c, a uint8) uint8 {
+	return uint8((uint32(c)*255 + uint32(a)/2) / uint32(a))
+}
+
+func premultiply(c, a uint8) uint8 {
+	return uint8((uint32(c)*uint32(a) + 127) / 255)
+}
@@ -0,0 +1,156 @@
+package iconpatch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxColorDistance is the distance between black and white in RGB space.
+var maxColorDistance = math.Sqrt(3 * 255 * 255)
+
+// RemoveBackground clears the pixels that are reachable from the border of the
+// icon through pixels within tolerance (in percent) of bg, or transparent ones.
+// Unlike Patch, a white glyph enclosed in a colored shape is left alone.
+//
+// Pixels bordering the cleared area that are within twice the tolerance are
+// anti-aliasing between the shape and the background: they are kept with a
+// partial alpha, and the background is subtracted from their color.
+func RemoveBackground(icon image.Image, bg color.NRGBA, tolerance float64) *image.NRGBA {
+	img := ToNRGBA(icon)
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return img
+	}
+
+	threshold := tolerance / 100 * maxColorDistance
+
+	distance := func(i int) float64 {
+		p := img.Pix[i : i+4 : i+4]
+		if p[3] <= 5 {
+			return 0
+		}
+
+		dr, dg, db := float64(p[0])-float64(bg.R), float64(p[1])-float64(bg.G), float64(p[2])-float64(bg.B)
+
+		return math.Sqrt(dr*dr + dg*dg + db*db)
+	}
+
+	offset := func(x, y int) int {
+		return y*img.Stride + x*4
+	}
+
+	cleared := make([]bool, w*h)
+	queue := make([]int, 0, 2*(w+h))
+
+	visit := func(x, y int) {
+		if cleared[y*w+x] || distance(offset(x, y)) > threshold {
+			return
+		}
+
+		cleared[y*w+x] = true
+		queue = append(queue, y*w+x)
+	}
+
+	for x := 0; x < w; x++ {
+		visit(x, 0)
+		visit(x, h-1)
+	}
+
+	for y := 0; y < h; y++ {
+		visit(0, y)
+		visit(w-1, y)
+	}
+
+	for len(queue) > 0 {
+		i := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		x, y := i%w, i/w
+		if x > 0 {
+			visit(x-1, y)
+		}
+		if x < w-1 {
+			visit(x+1, y)
+		}
+		if y > 0 {
+			visit(x, y-1)
+		}
+		if y < h-1 {
+			visit(x, y+1)
+		}
+	}
+
+	touchesCleared := func(x, y int) bool {
+		return (x > 0 && cleared[y*w+x-1]) || (x < w-1 && cleared[y*w+x+1]) ||
+			(y > 0 && cleared[(y-1)*w+x]) || (y < h-1 && cleared[(y+1)*w+x])
+	}
+
+	// Feathering is decided on the original pixels, so it is done in a
+	// separate pass before clearing anything.
+	type feathered struct {
+		offset int
+		alpha  float64
+	}
+	var edges []feathered
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if cleared[y*w+x] || !touchesCleared(x, y) {
+				continue
+			}
+
+			d := distance(offset(x, y))
+			if threshold > 0 && d < 2*threshold {
+				edges = append(edges, feathered{offset(x, y), (d - threshold) / threshold})
+			}
+		}
+	}
+
+	for _, edge := range edges {
+		p := img.Pix[edge.offset : edge.offset+4 : edge.offset+4]
+		a := edge.alpha
+
+		// p = c*a + bg*(1-a), solved for c.
+		p[0] = unblend(p[0], bg.R, a)
+		p[1] = unblend(p[1], bg.G, a)
+		p[2] = unblend(p[2], bg.B, a)
+		p[3] = uint8(float64(p[3])*a + 0.5)
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if cleared[y*w+x] {
+				i := offset(x, y)
+				img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = 255, 255, 255, 0
+			}
+		}
+	}
+
+	return img
+}
+
+func unblend(c, bg uint8, alpha float64) uint8 {
+	v := (float64(c) - float64(bg)*(1-alpha)) / alpha
+
+	return uint8(math.Max(0, math.Min(255, v)) + 0.5)
+}
+
+// ParseHexColor parses colors written as "rrggbb", "#rrggbb" or "rgb".
+func ParseHexColor(s string) (color.NRGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil || len(s) != 6 {
+		return color.NRGBA{}, fmt.Errorf("%q is not a hex color", s)
+	}
+
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
@@ -2,39 +2,79 @@ package iconpatch
 
 import (
 	"image"
-	"image/color"
 )
 
-func isWhiteish(r, g, b, a float64) bool {
+// isWhiteish works on alpha-premultiplied 8 bits components, so that a
+// half transparent white is not considered whiteish.
+func isWhiteish(r, g, b, a uint8) bool {
 	if a <= 5 {
 		return true
 	}
 
-	return (((0.2126*r + 0.7152*g + 0.0722*b) / 255) * 100) >= 90
+	// 90% of the maximum luminance, with coefficients scaled by 10^4.
+	return 2126*uint32(r)+7152*uint32(g)+722*uint32(b) >= 2295000
 }
 
-func Patch(icon image.Image) (*image.NRGBA64, bool) {
-	bounds := icon.Bounds()
-	rgba := image.NewNRGBA64(bounds)
-	filled := 0.0
+func isWhiteishPixel(p []uint8) bool {
+	a := p[3]
+
+	return isWhiteish(premultiply(p[0], a), premultiply(p[1], a), premultiply(p[2], a), a)
+}
+
+// Patch makes every whiteish or transparent pixel of an icon transparent white.
+func Patch(icon image.Image) (*image.NRGBA, bool) {
+	img := ToNRGBA(icon)
+	filled := 0
+
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4 : i+4]
+
+		if isWhiteishPixel(p) {
+			p[0], p[1], p[2], p[3] = 255, 255, 255, 0
+		} else {
+			filled++
+		}
+	}
+
+	return img, isFilled(filled, img.Bounds())
+}
+
+// Filled reports whether at least 85% of the icon is neither transparent nor whiteish.
+func Filled(icon image.Image) bool {
+	return FilledPercent(icon) >= 85
+}
+
+// FilledPercent returns the share of the icon, from 0 to 100, that is neither
+// transparent nor whiteish.
+func FilledPercent(icon image.Image) float64 {
+	img, ok := icon.(*image.NRGBA)
+	if !ok {
+		img = ToNRGBA(icon)
+	}
+
+	bounds := img.Bounds()
+	filled := 0
 
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r32, g32, b32, a32 := icon.At(x, y).RGBA()
-			rF, gF, bF, aF := float64(r32>>8), float64(g32>>8), float64(b32>>8), float64(a32>>8)
-			r, g, b, a := uint8(rF), uint8(gF), uint8(bF), uint8(aF)
-
-			if isWhiteish(rF, gF, bF, aF) || a == 0 {
-				rgba.Set(x, y, color.RGBA{255, 255, 255, 0})
-			} else {
+		i := img.PixOffset(bounds.Min.X, y)
+		row := img.Pix[i : i+bounds.Dx()*4 : i+bounds.Dx()*4]
+
+		for x := 0; x < len(row); x += 4 {
+			if !isWhiteishPixel(row[x : x+4 : x+4]) {
 				filled++
-				rgba.Set(x, y, color.RGBA{r, g, b, a})
 			}
 		}
 	}
 
+	return filledPercent(filled, bounds)
+}
+
+func isFilled(filled int, bounds image.Rectangle) bool {
+	return filledPercent(filled, bounds) >= 85
+}
+
+func filledPercent(filled int, bounds image.Rectangle) float64 {
 	totalFillable := float64(bounds.Dy() * bounds.Dx())
-	filledPercent := (filled / totalFillable) * 100
 
-	return rgba, filledPercent >= 85
+	return (float64(filled) / totalFillable) * 100
 }
@@ -0,0 +1,164 @@
+package iconpatch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"testing"
+)
+
+type sample struct {
+	name string
+	img  image.Image
+}
+
+// samples draws the same gradient with a white border in each image type the
+// decoders produce, over rect.
+func samples(rect image.Rectangle) []sample {
+	nrgba := image.NewNRGBA(rect)
+	rgba := image.NewRGBA(rect)
+	paletted := image.NewPaletted(rect, palette.WebSafe)
+	gray := image.NewGray(rect)
+	ycbcr := image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+
+	border := rect.Dx() / 8
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			c := color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: uint8(x + y)}
+			if x-rect.Min.X < border || y-rect.Min.Y < border {
+				c = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+			}
+
+			nrgba.SetNRGBA(x, y, c)
+			rgba.Set(x, y, c)
+			paletted.Set(x, y, c)
+			gray.Set(x, y, c)
+
+			yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+			ycbcr.Y[ycbcr.YOffset(x, y)] = yy
+			ycbcr.Cb[ycbcr.COffset(x, y)] = cb
+			ycbcr.Cr[ycbcr.COffset(x, y)] = cr
+		}
+	}
+
+	return []sample{
+		{"nrgba", nrgba},
+		{"rgba", rgba},
+		{"paletted", paletted},
+		{"gray", gray},
+		{"ycbcr", ycbcr},
+	}
+}
+
+// Patch and ToNRGBA work on the Pix slices of the decoded images, they must
+// give what the per-pixel At loops did, to within the rounding of colors to 8
+// bits.
+func TestMatchesLegacy(t *testing.T) {
+	for _, rect := range []image.Rectangle{
+		image.Rect(0, 0, 64, 64),
+		image.Rect(3, 5, 67, 45),
+	} {
+		for _, sample := range samples(rect) {
+			t.Run(fmt.Sprintf("%s %v", sample.name, rect), func(t *testing.T) {
+				converted := ToNRGBA(sample.img)
+				patched, filled := Patch(sample.img)
+				legacy, legacyFilled := legacyPatch(sample.img)
+
+				if filled != legacyFilled {
+					t.Errorf("filled %v, legacy %v", filled, legacyFilled)
+				}
+
+				for y := rect.Min.Y; y < rect.Max.Y; y++ {
+					for x := rect.Min.X; x < rect.Max.X; x++ {
+						at := image.Pt(x-rect.Min.X, y-rect.Min.Y)
+
+						want := color.NRGBAModel.Convert(sample.img.At(x, y)).(color.NRGBA)
+						if got := converted.NRGBAAt(at.X, at.Y); !closeColors(got, want) {
+							t.Fatalf("ToNRGBA: pixel (%d, %d) is %v, want %v", x, y, got, want)
+						}
+
+						// The legacy loop kept premultiplied 8 bit colors,
+						// that is what it is exact for.
+						legacyPixel := color.RGBAModel.Convert(legacy.At(x, y)).(color.RGBA)
+						patchedPixel := color.RGBAModel.Convert(patched.NRGBAAt(at.X, at.Y)).(color.RGBA)
+						if got, want := color.NRGBA(patchedPixel), color.NRGBA(legacyPixel); !closeColors(got, want) {
+							t.Fatalf("Patch: premultiplied pixel (%d, %d) is %v, want %v", x, y, got, want)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// closeColors tells whether a and b differ by one at most on each channel. The
+// color of transparent pixels does not matter.
+func closeColors(a, b color.NRGBA) bool {
+	if a.A == 0 && b.A == 0 {
+		return true
+	}
+
+	near := func(u, v uint8) bool { return max(u, v)-min(u, v) <= 1 }
+
+	return near(a.R, b.R) && near(a.G, b.G) && near(a.B, b.B) && a.A == b.A
+}
+
+func BenchmarkPatch(b *testing.B) {
+	for _, sample := range samples(image.Rect(0, 0, 512, 512)) {
+		b.Run(sample.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				Patch(sample.img)
+			}
+		})
+	}
+}
+
+// BenchmarkPatchLegacy is the per-pixel interface based loop Patch replaced,
+// to compare against.
+func BenchmarkPatchLegacy(b *testing.B) {
+	for _, sample := range samples(image.Rect(0, 0, 512, 512)) {
+		b.Run(sample.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				legacyPatch(sample.img)
+			}
+		})
+	}
+}
+
+// legacyPatch is Patch as it was before working on Pix slices.
+func legacyPatch(icon image.Image) (*image.NRGBA64, bool) {
+	bounds := icon.Bounds()
+	rgba := image.NewNRGBA64(bounds)
+	filled := 0.0
+
+	isWhiteish := func(r, g, b, a float64) bool {
+		if a <= 5 {
+			return true
+		}
+
+		return (((0.2126*r + 0.7152*g + 0.0722*b) / 255) * 100) >= 90
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r32, g32, b32, a32 := icon.At(x, y).RGBA()
+			rF, gF, bF, aF := float64(r32>>8), float64(g32>>8), float64(b32>>8), float64(a32>>8)
+			r, g, b, a := uint8(rF), uint8(gF), uint8(bF), uint8(aF)
+
+			if isWhiteish(rF, gF, bF, aF) || a == 0 {
+				rgba.Set(x, y, color.RGBA{255, 255, 255, 0})
+			} else {
+				filled++
+				rgba.Set(x, y, color.RGBA{r, g, b, a})
+			}
+		}
+	}
+
+	totalFillable := float64(bounds.Dy() * bounds.Dx())
+	filledPercent := (filled / totalFillable) * 100
+
+	return rgba, filledPercent >= 85
+}
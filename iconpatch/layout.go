@@ -0,0 +1,74 @@
+package iconpatch
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Trim crops the fully transparent borders of an icon.
+func Trim(icon image.Image) *image.NRGBA {
+	img := ToNRGBA(icon)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	content := image.Rectangle{}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if img.Pix[y*img.Stride+x*4+3] != 0 {
+				content = content.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	if content.Empty() {
+		return img
+	}
+
+	return img.SubImage(content).(*image.NRGBA)
+}
+
+// The canvas made by Square grows without bounds as padding nears 50 percent.
+// Padding is capped, and so is the canvas unless the icon is that large itself.
+const (
+	MaxSquarePadding = 40
+	MaxSquareSide    = 1024
+)
+
+// SquareSide returns the side of the canvas Square makes for an icon with
+// these bounds.
+func SquareSide(bounds image.Rectangle, padding float64) int {
+	side := max(bounds.Dx(), bounds.Dy())
+	margin := int(math.Round(float64(side) * padding / (100 - 2*padding)))
+
+	return side + 2*margin
+}
+
+// Square centers an icon on a transparent square canvas, leaving padding
+// percent of the canvas size empty on each side.
+func Square(icon image.Image, padding float64) *image.NRGBA {
+	bounds := icon.Bounds()
+	canvasSide := SquareSide(bounds, padding)
+
+	img := image.NewNRGBA(image.Rect(0, 0, canvasSide, canvasSide))
+	offset := image.Pt((canvasSide-bounds.Dx())/2, (canvasSide-bounds.Dy())/2)
+	draw.Draw(img, bounds.Sub(bounds.Min).Add(offset), icon, bounds.Min, draw.Src)
+
+	return img
+}
+
+// Mask clips an icon to a rounded rectangle whose corner radius is radius
+// percent of its smallest side, 50 giving a circle for square icons.
+func Mask(icon image.Image, radius float64) *image.NRGBA {
+	img := ToNRGBA(icon)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	r := float64(min(w, h)) * radius / 100
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := y*img.Stride + x*4 + 3
+			img.Pix[i] = uint8(float64(img.Pix[i])*roundedRectCoverage(x, y, float64(w), float64(h), r) + 0.5)
+		}
+	}
+
+	return img
+}
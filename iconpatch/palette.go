@@ -0,0 +1,188 @@
+package iconpatch
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+)
+
+// paletteSize is the number of colors Analyze extracts at most.
+const paletteSize = 5
+
+// maxSamples bounds the number of pixels looked at by Analyze.
+const maxSamples = 1 << 14
+
+type Analysis struct {
+	// Dominant is the most common color of the icon, transparent if it has no visible pixel.
+	Dominant color.NRGBA
+	// Palette lists the main colors of the icon, most common first.
+	Palette []color.NRGBA
+	// Luminance is the average relative luminance of the visible pixels.
+	Luminance float64
+}
+
+// Analyze extracts the colors of an icon with a median cut over its visible pixels.
+func Analyze(icon image.Image) Analysis {
+	img := ToNRGBA(icon)
+
+	pixelCount := len(img.Pix) / 4
+	step := max(1, pixelCount/maxSamples)
+
+	var pixels []color.NRGBA
+	var luminance float64
+	for i := 0; i < pixelCount; i += step {
+		p := img.Pix[i*4 : i*4+4 : i*4+4]
+		if p[3] < 128 {
+			continue
+		}
+
+		c := color.NRGBA{R: p[0], G: p[1], B: p[2], A: 255}
+		pixels = append(pixels, c)
+		luminance += RelativeLuminance(c)
+	}
+
+	if len(pixels) == 0 {
+		return Analysis{}
+	}
+
+	analysis := Analysis{
+		Palette:   paletteOf(pixels, paletteSize),
+		Luminance: luminance / float64(len(pixels)),
+	}
+	analysis.Dominant = analysis.Palette[0]
+
+	return analysis
+}
+
+// ExtractPalette returns at most k colors representing the visible pixels
+// of icon, most common first.
+func ExtractPalette(icon image.Image, k int) []color.NRGBA {
+	img := ToNRGBA(icon)
+
+	pixelCount := len(img.Pix) / 4
+	step := max(1, pixelCount/maxSamples)
+
+	var pixels []color.NRGBA
+	for i := 0; i < pixelCount; i += step {
+		p := img.Pix[i*4 : i*4+4 : i*4+4]
+		if p[3] >= 128 {
+			pixels = append(pixels, color.NRGBA{R: p[0], G: p[1], B: p[2], A: 255})
+		}
+	}
+
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	return paletteOf(pixels, k)
+}
+
+func paletteOf(pixels []color.NRGBA, k int) []color.NRGBA {
+	var palette []color.NRGBA
+	for _, box := range medianCut(pixels, k) {
+		palette = append(palette, box.average())
+	}
+
+	return palette
+}
+
+// HexColor formats c as "#rrggbb".
+func HexColor(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+type colorBox []color.NRGBA
+
+func (b colorBox) channel(c color.NRGBA, ch int) uint8 {
+	switch ch {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	default:
+		return c.B
+	}
+}
+
+// widest returns the channel with the largest spread and that spread.
+func (b colorBox) widest() (int, int) {
+	bestChannel, bestRange := 0, -1
+	for ch := 0; ch < 3; ch++ {
+		lo, hi := uint8(255), uint8(0)
+		for _, c := range b {
+			v := b.channel(c, ch)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+
+		if int(hi)-int(lo) > bestRange {
+			bestChannel, bestRange = ch, int(hi)-int(lo)
+		}
+	}
+
+	return bestChannel, bestRange
+}
+
+func (b colorBox) average() color.NRGBA {
+	var r, g, bl int
+	for _, c := range b {
+		r, g, bl = r+int(c.R), g+int(c.G), bl+int(c.B)
+	}
+
+	n := len(b)
+
+	return color.NRGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: 255}
+}
+
+// medianCut splits pixels in at most k boxes of similar colors, largest boxes first.
+func medianCut(pixels []color.NRGBA, k int) []colorBox {
+	boxes := []colorBox{pixels}
+
+	for len(boxes) < k {
+		// Split the box whose spread weighs the most.
+		split, splitScore := -1, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+
+			_, spread := box.widest()
+			if score := spread * len(box); spread > 0 && score > splitScore {
+				split, splitScore = i, score
+			}
+		}
+
+		if split < 0 {
+			break
+		}
+
+		box := boxes[split]
+		ch, _ := box.widest()
+		sort.Slice(box, func(i, j int) bool {
+			return box.channel(box[i], ch) < box.channel(box[j], ch)
+		})
+
+		// Cut between two different values, so that a color never ends up
+		// on both sides of the split.
+		value := func(i int) uint8 { return box.channel(box[i], ch) }
+		median := len(box) / 2
+		for median < len(box) && value(median) == value(median-1) {
+			median++
+		}
+		if median == len(box) {
+			median = len(box) / 2
+			for median > 1 && value(median-1) == value(median) {
+				median--
+			}
+		}
+
+		boxes[split] = box[:median:median]
+		boxes = append(boxes, box[median:])
+	}
+
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return len(boxes[i]) > len(boxes[j])
+	})
+
+	return boxes
+}
@@ -0,0 +1,266 @@
+package iconpatch
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Params holds the parameters of a single Step.
+type Params map[string]string
+
+func (p Params) Float(key string, def float64) (float64, error) {
+	v, ok := p[key]
+	if !ok {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("%s: %q is not a number", key, v)
+	}
+
+	return f, nil
+}
+
+func (p Params) String(key, def string) string {
+	if v, ok := p[key]; ok {
+		return v
+	}
+
+	return def
+}
+
+// Step is a named transform along with its parameters.
+type Step struct {
+	Name   string
+	Params Params
+}
+
+// Pipeline is a list of transforms applied in order.
+//
+// Its textual form, used by ParsePipeline and String, separates steps with
+// commas and parameters with colons: "whitekey,pad:percent=10".
+type Pipeline []Step
+
+// DefaultPipeline is used when no transform is requested.
+var DefaultPipeline = Pipeline{{Name: "edgekey"}}
+
+type transform struct {
+	params []string
+	apply  func(img image.Image, params Params, meta map[string]string) (image.Image, error)
+}
+
+var transforms = map[string]transform{
+	"original": {
+		apply: func(img image.Image, _ Params, _ map[string]string) (image.Image, error) {
+			return img, nil
+		},
+	},
+	"whitekey": {
+		apply: func(img image.Image, _ Params, _ map[string]string) (image.Image, error) {
+			patched, _ := Patch(img)
+			return patched, nil
+		},
+	},
+	"edgekey": {
+		params: []string{"color", "tolerance"},
+		apply: func(img image.Image, params Params, _ map[string]string) (image.Image, error) {
+			bg, err := ParseHexColor(params.String("color", "ffffff"))
+			if err != nil {
+				return nil, err
+			}
+
+			tolerance, err := params.Float("tolerance", 10)
+			if err != nil {
+				return nil, err
+			}
+
+			if tolerance < 0 || tolerance > 100 {
+				return nil, errors.New("tolerance must be between 0 and 100")
+			}
+
+			return RemoveBackground(img, bg, tolerance), nil
+		},
+	},
+	"trim": {
+		apply: func(img image.Image, _ Params, _ map[string]string) (image.Image, error) {
+			return Trim(img), nil
+		},
+	},
+	"square": {
+		params: []string{"padding"},
+		apply: func(img image.Image, params Params, _ map[string]string) (image.Image, error) {
+			padding, err := params.Float("padding", 0)
+			if err != nil {
+				return nil, err
+			}
+
+			if padding < 0 || padding > MaxSquarePadding {
+				return nil, fmt.Errorf("padding must be between 0 and %d", MaxSquarePadding)
+			}
+
+			bounds := img.Bounds()
+			if side := SquareSide(bounds, padding); side > MaxSquareSide && side > max(bounds.Dx(), bounds.Dy()) {
+				return nil, fmt.Errorf("padding would make a %dpx canvas, more than %dpx", side, MaxSquareSide)
+			}
+
+			return Square(img, padding), nil
+		},
+	},
+	"mask": {
+		params: []string{"shape", "radius"},
+		apply: func(img image.Image, params Params, _ map[string]string) (image.Image, error) {
+			radius, err := params.Float("radius", 20)
+			if err != nil {
+				return nil, err
+			}
+
+			switch params.String("shape", "rounded") {
+			case "circle":
+				radius = 50
+			case "rounded":
+				if radius < 0 || radius > 50 {
+					return nil, errors.New("radius must be between 0 and 50")
+				}
+			default:
+				return nil, errors.New("shape must be rounded or circle")
+			}
+
+			return Mask(img, radius), nil
+		},
+	},
+}
+
+var ErrInvalidPipeline = errors.New("invalid transform")
+
+// Every step is run on each resolved icon, and the canonical form of the
+// pipeline is stored in the icon metadata, limited to 2KB in total.
+const (
+	MaxPipelineSteps  = 16
+	MaxPipelineLength = 256
+)
+
+func ParsePipeline(s string) (Pipeline, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return DefaultPipeline, nil
+	}
+
+	if len(s) > MaxPipelineLength {
+		return nil, fmt.Errorf("%w: longer than %d characters", ErrInvalidPipeline, MaxPipelineLength)
+	}
+
+	if strings.Count(s, ",") >= MaxPipelineSteps {
+		return nil, fmt.Errorf("%w: more than %d steps", ErrInvalidPipeline, MaxPipelineSteps)
+	}
+
+	var pipeline Pipeline
+	for _, rawStep := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(rawStep), ":")
+
+		step := Step{Name: strings.ToLower(fields[0])}
+
+		t, ok := transforms[step.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown transform %q", ErrInvalidPipeline, step.Name)
+		}
+
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok || !contains(t.params, key) {
+				return nil, fmt.Errorf("%w: unknown parameter %q for %s", ErrInvalidPipeline, field, step.Name)
+			}
+
+			if step.Params == nil {
+				step.Params = Params{}
+			}
+
+			step.Params[key] = value
+		}
+
+		pipeline = append(pipeline, step)
+	}
+
+	// Surface bad parameter values now rather than when the icon is processed.
+	if _, err := pipeline.Run(image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPipeline, err)
+	}
+
+	return pipeline, nil
+}
+
+// String returns the canonical form of the pipeline, parameters being sorted.
+func (p Pipeline) String() string {
+	buf := &strings.Builder{}
+
+	for i, step := range p {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		buf.WriteString(step.Name)
+
+		keys := make([]string, 0, len(step.Params))
+		for key := range step.Params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			buf.WriteByte(':')
+			buf.WriteString(key)
+			buf.WriteByte('=')
+			buf.WriteString(step.Params[key])
+		}
+	}
+
+	return buf.String()
+}
+
+func (p Pipeline) IsDefault() bool {
+	return p.String() == DefaultPipeline.String()
+}
+
+type Result struct {
+	Image image.Image
+	// Filled is set when the icon covers most of its canvas.
+	Filled   bool
+	Analysis Analysis
+	// Meta holds what the transforms report about the changes they made.
+	Meta map[string]string
+}
+
+func (p Pipeline) Run(icon image.Image) (*Result, error) {
+	res := &Result{
+		Image: icon,
+		Meta:  map[string]string{},
+	}
+
+	for _, step := range p {
+		var err error
+		res.Image, err = transforms[step.Name].apply(res.Image, step.Params, res.Meta)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.Name, err)
+		}
+	}
+
+	res.Filled = Filled(res.Image)
+	res.Analysis = Analyze(res.Image)
+
+	return res, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
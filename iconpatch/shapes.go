@@ -0,0 +1,22 @@
+package iconpatch
+
+import "math"
+
+// roundedRectCoverage returns how much of the pixel at (x, y) lies inside a
+// w by h rectangle whose corners are rounded with radius r, from 0 to 1.
+func roundedRectCoverage(x, y int, w, h, r float64) float64 {
+	r = math.Min(r, math.Min(w, h)/2)
+
+	px, py := float64(x)+0.5, float64(y)+0.5
+	if px < 0 || py < 0 || px > w || py > h {
+		return 0
+	}
+
+	// Distance from the pixel center to the rounded rectangle, negative inside.
+	dx := math.Max(math.Abs(px-w/2)-(w/2-r), 0)
+	dy := math.Max(math.Abs(py-h/2)-(h/2-r), 0)
+	d := math.Hypot(dx, dy) - r
+
+	// A one pixel wide ramp is enough to anti-alias the edge.
+	return math.Max(0, math.Min(1, 0.5-d))
+}
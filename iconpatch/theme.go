@@ -0,0 +1,239 @@
+package iconpatch
+
+import (
+	"golang.org/x/image/draw"
+	"image"
+	"image/color"
+	"math"
+)
+
+// DarkBackground is the color dark variants are checked against by default.
+var DarkBackground = color.NRGBA{R: 0x1E, G: 0x1E, B: 0x1E, A: 0xFF}
+
+// Adjustment tells what ApplyAdjustment does to an icon to make it legible on
+// a background, typically for dark themes.
+type Adjustment string
+
+const (
+	AdjustNone    Adjustment = "none"
+	AdjustInvert  Adjustment = "invert"
+	AdjustOutline Adjustment = "outline"
+	AdjustPlate   Adjustment = "plate"
+)
+
+// minContrast is the WCAG contrast ratio for graphical objects.
+const minContrast = 3
+
+var lightColor = color.NRGBA{R: 0xF5, G: 0xF5, B: 0xF5, A: 0xFF}
+
+// RelativeLuminance implements the WCAG 2 definition, from 0 for black to 1 for white.
+func RelativeLuminance(c color.NRGBA) float64 {
+	linear := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.04045 {
+			return s / 12.92
+		}
+
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+
+	return 0.2126*linear(c.R) + 0.7152*linear(c.G) + 0.0722*linear(c.B)
+}
+
+// ContrastRatio between two relative luminances, from 1 to 21.
+func ContrastRatio(a, b float64) float64 {
+	return (math.Max(a, b) + 0.05) / (math.Min(a, b) + 0.05)
+}
+
+type visibility struct {
+	// legible is the share of visible pixels contrasting enough with the background
+	legible float64
+	// coverage is the share of the canvas that is visible
+	coverage float64
+	// monochrome is set when nearly every visible pixel is a shade of gray
+	monochrome bool
+}
+
+func measureVisibility(img *image.NRGBA, bg color.NRGBA) visibility {
+	bgLuminance := RelativeLuminance(bg)
+
+	var weight, legible, gray float64
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		p := img.Pix[i : i+4 : i+4]
+		if p[3] < 16 {
+			continue
+		}
+
+		a := float64(p[3]) / 255
+		l := RelativeLuminance(color.NRGBA{R: p[0], G: p[1], B: p[2], A: p[3]})
+
+		weight += a
+		if ContrastRatio(l, bgLuminance) >= minContrast {
+			legible += a
+		}
+
+		maxC := max(p[0], p[1], p[2])
+		minC := min(p[0], p[1], p[2])
+		if maxC == 0 || float64(maxC-minC)/float64(maxC) < 0.15 {
+			gray += a
+		}
+	}
+
+	if weight == 0 {
+		return visibility{}
+	}
+
+	return visibility{
+		legible:    legible / weight,
+		coverage:   weight / float64(img.Bounds().Dx()*img.Bounds().Dy()),
+		monochrome: gray/weight >= 0.95,
+	}
+}
+
+// ChooseAdjustment decides how to make icon legible on bg: monochrome glyphs
+// are inverted, other sparse icons get a light outline and the remaining ones
+// are set on a light backing plate. The frames of an animation all get the
+// adjustment chosen for one of them, otherwise it may change from frame to
+// frame.
+func ChooseAdjustment(icon image.Image, bg color.NRGBA) Adjustment {
+	v := measureVisibility(ToNRGBA(icon), bg)
+	switch {
+	case v.coverage == 0 || v.legible >= 0.5:
+		return AdjustNone
+	case v.monochrome:
+		return AdjustInvert
+	case v.coverage < 0.5:
+		return AdjustOutline
+	default:
+		return AdjustPlate
+	}
+}
+
+// ApplyAdjustment returns icon with adjustment applied.
+func ApplyAdjustment(icon image.Image, adjustment Adjustment) *image.NRGBA {
+	img := ToNRGBA(icon)
+
+	switch adjustment {
+	case AdjustInvert:
+		return invert(img)
+	case AdjustOutline:
+		return outline(img, lightColor)
+	case AdjustPlate:
+		return plate(img, lightColor)
+	default:
+		return img
+	}
+}
+
+func invert(img *image.NRGBA) *image.NRGBA {
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		img.Pix[i] = 255 - img.Pix[i]
+		img.Pix[i+1] = 255 - img.Pix[i+1]
+		img.Pix[i+2] = 255 - img.Pix[i+2]
+	}
+
+	return img
+}
+
+// maxOutlineRadius bounds the width of the outline band, reached by 1024px icons.
+const maxOutlineRadius = 32
+
+// outline draws a band of c around the visible shape of img, about 1/32th of its size.
+func outline(img *image.NRGBA, c color.NRGBA) *image.NRGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	radius := min(max(1, min(w, h)/32), maxOutlineRadius)
+
+	alpha := make([]uint8, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			alpha[y*w+x] = img.Pix[y*img.Stride+x*4+3]
+		}
+	}
+
+	// The disk is dilated one row offset at a time: the row dy away is
+	// maxed over the half width of the disk at dy, which only takes radius+1
+	// distinct values. That keeps the cost at O(w·h·radius).
+	band := make([]uint8, w*h)
+	rowMax := make([]uint8, w*h)
+	queue := make([]int, 0, w)
+	for halfWidth := radius; halfWidth >= 0; halfWidth-- {
+		computed := false
+		for dy := -radius; dy <= radius; dy++ {
+			if int(math.Sqrt(float64(radius*radius-dy*dy))) != halfWidth {
+				continue
+			}
+
+			if !computed {
+				for y := 0; y < h; y++ {
+					queue = slidingMax(rowMax[y*w:(y+1)*w], alpha[y*w:(y+1)*w], halfWidth, queue)
+				}
+				computed = true
+			}
+
+			for y := max(0, -dy); y < min(h, h-dy); y++ {
+				dst, src := band[y*w:(y+1)*w], rowMax[(y+dy)*w:(y+dy+1)*w]
+				for x := range dst {
+					dst[x] = max(dst[x], src[x])
+				}
+			}
+		}
+	}
+
+	out := image.NewNRGBA(img.Bounds())
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			out.SetNRGBA(x, y, color.NRGBA{R: c.R, G: c.G, B: c.B, A: band[y*w+x]})
+		}
+	}
+
+	draw.Draw(out, out.Bounds(), img, image.Point{}, draw.Over)
+
+	return out
+}
+
+// slidingMax sets dst[x] to the largest of src[x-k:x+k+1], clipped to src,
+// keeping in queue the indexes of the decreasing maximums of the window.
+func slidingMax(dst, src []uint8, k int, queue []int) []int {
+	queue = queue[:0]
+	head := 0
+
+	for x := 0; x < len(src)+k; x++ {
+		if x < len(src) {
+			for len(queue) > head && src[queue[len(queue)-1]] <= src[x] {
+				queue = queue[:len(queue)-1]
+			}
+			queue = append(queue, x)
+		}
+
+		center := x - k
+		if center < 0 {
+			continue
+		}
+
+		for queue[head] < center-k {
+			head++
+		}
+		dst[center] = src[queue[head]]
+	}
+
+	return queue
+}
+
+// plate sets img, slightly scaled down, on a rounded rectangle of color c.
+func plate(img *image.NRGBA, c color.NRGBA) *image.NRGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+
+	out := image.NewNRGBA(img.Bounds())
+	radius := float64(min(w, h)) * 0.2
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			coverage := roundedRectCoverage(x, y, float64(w), float64(h), radius)
+			out.SetNRGBA(x, y, color.NRGBA{R: c.R, G: c.G, B: c.B, A: uint8(coverage*255 + 0.5)})
+		}
+	}
+
+	inset := image.Rect(w/10, h/10, w-w/10, h-h/10)
+	draw.CatmullRom.Scale(out, inset, img, img.Bounds(), draw.Over, nil)
+
+	return out
+}
@@ -1,35 +1,60 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"faviconapi/defaults"
+	"faviconapi/favicon"
 	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/ratelimit"
-	"golang.org/x/net/context"
-	"image/png"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
-const Version = "13"
+const Version = "18"
+
+// cacheLifetime is how long icon metadata is served from memory without
+// checking that the entry still exists in storage.
+const cacheLifetime = 30 * 24 * time.Hour
 
 type Context struct {
-	limiter ratelimit.Limiter
-	cache   *cache.Cache
-	s3      *s3.Client
-	log     zerolog.Logger
+	limiter  ratelimit.Limiter
+	cache    *cache.Cache
+	s3       *s3.Client
+	resolver *favicon.Resolver
+	log      zerolog.Logger
+	// request is the context of the request being served, carrying its span.
+	request   context.Context
+	requestID string
+}
+
+// requestContext returns the context outbound calls made for the current
+// request should use.
+func (ctx Context) requestContext() context.Context {
+	if ctx.request == nil {
+		return context.Background()
+	}
+
+	return ctx.request
 }
 
 type HttpResponse struct {
@@ -37,11 +62,17 @@ type HttpResponse struct {
 	Status  int               `json:"status"`
 	Value   any               `json:"value"`
 	Meta    map[string]string `json:"meta"`
+	// Error is set on failures, and when the fallback is returned for want of an icon.
+	Error     ErrorCode `json:"error,omitempty"`
+	RequestID string    `json:"requestId,omitempty"`
+	// Body, when set, is written instead of the response itself. Status still applies.
+	Body any `json:"-"`
 }
 
 var UnexpectedError = HttpResponse{
 	Status: http.StatusInternalServerError,
 	Value:  "unexpected error",
+	Error:  CodeUnexpected,
 }
 
 func unexpectedError(ctx Context, err error) HttpResponse {
@@ -55,155 +86,120 @@ func unexpectedError(ctx Context, err error) HttpResponse {
 var s3Bucket string
 var cdnHostForBucket string
 
-func GetFaviconEndpoint(ctx Context, rw http.ResponseWriter, r *http.Request) HttpResponse {
-	URL := r.URL.String()
+var (
+	errInvalidTargetURL = errors.New("url field must be a valid url")
+	errTargetURLTooLong = errors.New("url field must not be greater than 65,536 bytes")
+)
 
-	iconMetadata := map[string]string{
-		"version": Version,
-	}
+// parseTargetURL reads the URL of the site to look at, which follows prefix in
+// the path of r. The scheme defaults to https.
+func parseTargetURL(r *http.Request, prefix string) (*url.URL, error) {
+	URL := r.URL.String()
 
 	// Sanity check to prevent against path-traversal shenanigans from a malicious user agent.
-	if !strings.HasPrefix(URL, "/api/v1/resolve") {
-		return HttpResponse{Status: http.StatusBadRequest, Value: "url field must be a valid url"}
+	if !strings.HasPrefix(URL, prefix+"/") {
+		return nil, errInvalidTargetURL
 	}
 
-	var err error
-	URL, err = url.QueryUnescape(URL[len("/api/v1/resolve")+1:])
+	URL, err := url.QueryUnescape(URL[len(prefix)+1:])
 	if err != nil {
-		return unexpectedError(ctx, err)
+		return nil, err
 	}
 
-	fallbackURL := strings.TrimSpace(r.URL.Query().Get("fallbackURL"))
-
 	if len(URL) > 1<<16 {
-		return HttpResponse{Status: http.StatusBadRequest, Value: "url field must not be greater than 65,536 bytes"}
+		return nil, errTargetURLTooLong
 	}
 
-	parsedURL, err := url.ParseRequestURI(URL)
+	target, err := url.ParseRequestURI(URL)
 	if err != nil {
 		// Is the scheme missing?
-		fixedURL, err := url.ParseRequestURI("https://" + URL)
+		target, err = url.ParseRequestURI("https://" + URL)
 		if err != nil {
-			return HttpResponse{Status: http.StatusBadRequest, Value: "url field must be a valid url"}
+			return nil, errInvalidTargetURL
 		}
+	}
 
-		parsedURL = fixedURL
+	return target, nil
+}
+
+func GetFaviconEndpoint(ctx Context, rw http.ResponseWriter, r *http.Request) HttpResponse {
+	req, err := parseResolveRequest(r, "/api/v1/resolve")
+	if err != nil {
+		return errorResponse(ctx, err)
 	}
 
-	objectKey := "favicons/" + parsedURL.Hostname() + ".png"
-	objectURL := "https://" + cdnHostForBucket + "/" + objectKey
-	cacheKey := parsedURL.Hostname() + Version
+	fallbackURL := strings.TrimSpace(r.URL.Query().Get("fallbackURL"))
 
 	if defaults.CacheStatus == defaults.CacheEnabled {
 		// Zeroth layer: browser caching
 		rw.Header().Add("Cache-Control", "max-age=604800, immutable") // one week
-
-		// First layer: memory cache
-		if meta, ok := ctx.cache.Get(cacheKey); ok {
-			return HttpResponse{Success: true, Value: objectURL, Meta: meta.(map[string]string)}
-		}
-
-		// Second layer: lookup to see if there's an object with the future name of the icon.
-		head, err := ctx.s3.HeadObject(context.TODO(), &s3.HeadObjectInput{
-			Bucket: &s3Bucket,
-			Key:    &objectKey,
-		})
-		if err != nil {
-			var responseError *awshttp.ResponseError
-			if errors.As(err, &responseError) && responseError.ResponseError.HTTPStatusCode() == http.StatusNotFound {
-				//
-			} else {
-				return unexpectedError(ctx, err)
-			}
-		} else {
-			if head.Metadata["version"] == Version {
-				ctx.cache.Set(cacheKey, head.Metadata, cache.DefaultExpiration)
-
-				return HttpResponse{Success: true, Value: objectURL, Meta: head.Metadata}
-			}
-
-			// New version, keep going
-		}
 	}
 
-	ctx.limiter.Take()
-
-	resolvedIcon, err := FindFaviconURL(parsedURL)
+	res, err := resolveIcon(ctx, req)
 	if err != nil {
-		if errors.Is(err, ErrIconNotFound) {
+		if classifyError(err) == CodeIconNotFound {
 			return HttpResponse{
 				Success: true,
 				Status:  http.StatusOK,
 				Value:   fallbackURL,
-				Meta:    iconMetadata,
-			}
-		}
-
-		if errors.Is(err, ErrUnreachableServer) {
-			return HttpResponse{
-				Status: http.StatusBadRequest,
-				Value:  err.Error(),
+				Meta: map[string]string{
+					"version":   Version,
+					"transform": req.Pipeline.String(),
+				},
+				Error: CodeIconNotFound,
 			}
 		}
 
-		return unexpectedError(ctx, err)
-	}
-
-	patchedIcon, filled, err := PatchIcon(resolvedIcon)
-	if err != nil {
-		_ = resolvedIcon.Body.Close()
-		return unexpectedError(ctx, err)
-	}
-
-	if filled {
-		iconMetadata["filled"] = "yes"
-	} else {
-		iconMetadata["filled"] = "no"
-	}
-
-	_ = resolvedIcon.Body.Close()
-
-	buf := new(bytes.Buffer)
-	err = png.Encode(buf, patchedIcon)
-	if err != nil {
-		return unexpectedError(ctx, err)
-	}
-
-	_, err = ctx.s3.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      &s3Bucket,
-		Key:         &objectKey,
-		Body:        buf,
-		ContentType: aws.String(resolvedIcon.Type.ContentType()),
-		Metadata:    iconMetadata,
-		ACL:         "public-read",
-	})
-	if err != nil {
-		return unexpectedError(ctx, err)
-	}
-
-	if defaults.CacheStatus == defaults.CacheEnabled {
-		ctx.cache.Set(cacheKey, iconMetadata, cache.DefaultExpiration)
+		return errorResponse(ctx, err)
 	}
 
 	return HttpResponse{
 		Success: true,
-		Value:   objectURL,
-		Meta:    iconMetadata,
+		Value:   res.URL,
+		Meta:    res.Meta,
 	}
 }
 
-func Endpoint(ctx Context, handler func(Context, http.ResponseWriter, *http.Request) HttpResponse) http.Handler {
+// Endpoint serves handler, name labels its metrics.
+func Endpoint(ctx Context, name string, handler func(Context, http.ResponseWriter, *http.Request) HttpResponse) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+
+		spanCtx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		spanCtx, span := tracer.Start(spanCtx, name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPRequestMethodKey.String(r.Method), semconv.URLPath(r.URL.Path)))
+
+		id := requestID(r)
+
+		ctx := ctx
+		ctx.request = spanCtx
+		ctx.requestID = id
+		ctx.log = ctx.log.With().Str("requestId", id).Logger()
+
 		res := handler(ctx, rw, r)
 		elapsed := time.Since(start)
 		if res.Status == 0 {
 			res.Status = http.StatusOK
 		}
+		res.RequestID = id
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(res.Status))
+		if res.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(res.Status))
+		}
+		span.End()
 
 		rw.Header().Add("Content-Type", "application/json")
+		rw.Header().Set("X-Request-ID", id)
 		rw.WriteHeader(res.Status)
-		_ = json.NewEncoder(rw).Encode(res)
+		if res.Body != nil {
+			_ = json.NewEncoder(rw).Encode(res.Body)
+		} else {
+			_ = json.NewEncoder(rw).Encode(res)
+		}
+
+		requestsTotal.WithLabelValues(name, strconv.Itoa(res.Status)).Inc()
+		requestDuration.WithLabelValues(name).Observe(elapsed.Seconds())
 
 		ip := r.Header.Get("CF-Connecting-IP")
 		if ip == "" {
@@ -219,7 +215,13 @@ func Endpoint(ctx Context, handler func(Context, http.ResponseWriter, *http.Requ
 			}
 		}
 
-		ctx.log.Info().Str("ip", ip).
+		event := ctx.log.Info()
+		if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+			event = event.Str("traceId", spanContext.TraceID().String())
+		}
+
+		event.Str("ip", ip).
+			Str("error", string(res.Error)).
 			Str("ua", r.Header.Get("User-Agent")).
 			Str("method", r.Method).
 			Str("path", r.URL.String()).
@@ -233,7 +235,9 @@ func Endpoint(ctx Context, handler func(Context, http.ResponseWriter, *http.Requ
 	})
 }
 
-func runHttpServer(port string) error {
+// newContext builds the state shared by the server and the admin commands
+// from the environment.
+func newContext() (Context, error) {
 	accessKeyId := os.Getenv("AWS_ACCESS_KEY_ID")
 	secretAccessKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
 	endpoint := os.Getenv("AWS_ENDPOINT")
@@ -242,29 +246,123 @@ func runHttpServer(port string) error {
 	s3Bucket = os.Getenv("AWS_BUCKET")
 
 	if cdnHostForBucket == "" {
-		return errors.New("ASSET_URL_FOR_BUCKET is empty, please specify a URL")
+		return Context{}, errors.New("ASSET_URL_FOR_BUCKET is empty, please specify a URL")
 	}
 
 	if s3Bucket == "" {
-		return errors.New("AWS_BUCKET is empty, please specify a s3 bucket")
+		return Context{}, errors.New("AWS_BUCKET is empty, please specify a s3 bucket")
+	}
+
+	resolverOptions, err := favicon.OptionsFromEnv()
+	if err != nil {
+		return Context{}, err
+	}
+
+	resolverOptions.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return instrumentedTransport{next: rt}
 	}
 
-	ctx := Context{
+	resolver, err := favicon.NewResolver(resolverOptions)
+	if err != nil {
+		return Context{}, err
+	}
+
+	return Context{
 		limiter: ratelimit.New(100),
-		cache:   cache.New(time.Hour*24*30, time.Hour*24*5),
+		cache:   cache.New(cacheLifetime, time.Hour*24*5),
 		s3: s3.New(s3.Options{
 			Region:       region,
 			BaseEndpoint: aws.String("https://" + endpoint),
 			Credentials:  credentials.NewStaticCredentialsProvider(accessKeyId, secretAccessKey, ""),
 		}),
-		log: zerolog.New(os.Stderr).With().Timestamp().Str("version", Version).Logger(),
+		resolver: resolver,
+		log:      zerolog.New(os.Stderr).With().Timestamp().Str("version", Version).Logger(),
+	}, nil
+}
+
+func runHttpServer(port string) error {
+	ctx, err := newContext()
+	if err != nil {
+		return err
 	}
 
-	http.Handle("/api/v1/resolve/", Endpoint(ctx, GetFaviconEndpoint))
+	shutdownTracing, err := setupTracing()
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing(context.Background())
+
+	stopCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	snapshotDone := make(chan struct{})
+	if snapshotPath := os.Getenv("CACHE_SNAPSHOT_FILE"); snapshotPath != "" {
+		snapshotInterval := 5 * time.Minute
+		if v := os.Getenv("CACHE_SNAPSHOT_INTERVAL"); v != "" {
+			snapshotInterval, err = time.ParseDuration(v)
+			if err != nil || snapshotInterval <= 0 {
+				return fmt.Errorf("CACHE_SNAPSHOT_INTERVAL: invalid duration %q", v)
+			}
+		}
+
+		restored, discarded, err := loadCacheSnapshot(ctx.cache, snapshotPath)
+		if err != nil {
+			// A snapshot we cannot read only costs a cold start.
+			ctx.log.Error().Err(err).Msg("cannot load cache snapshot")
+		} else {
+			ctx.log.Info().Int("restored", restored).Int("discarded", discarded).Msg("loaded cache snapshot")
+		}
+
+		go func() {
+			snapshotCache(stopCtx, ctx.cache, snapshotPath, snapshotInterval, ctx.log)
+			close(snapshotDone)
+		}()
+	} else {
+		close(snapshotDone)
+	}
+
+	http.Handle("/api/v2/icons/", Endpoint(ctx, "icons", GetIconEndpointV2))
+	http.HandleFunc("/api/v2/openapi.json", GetOpenAPIEndpoint)
+	http.Handle("/api/v1/resolve/", Endpoint(ctx, "resolve", GetFaviconEndpoint))
+	http.Handle("/api/v1/explain/", Endpoint(ctx, "explain", GetExplainEndpoint))
+	http.Handle("/api/v1/shared/", Endpoint(ctx, "shared", GetSharedIconEndpoint))
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", HealthzEndpoint)
+	http.HandleFunc("/readyz", ReadyzEndpoint(ctx))
+	http.Handle("/selftest", Endpoint(ctx, "selftest", SelftestEndpoint))
 
 	ctx.log.Debug().Str("cacheStatus", defaults.CacheStatus).Msg("starting server")
 
-	return http.ListenAndServe(port, nil)
+	server := &http.Server{Addr: port}
+
+	go func() {
+		<-stopCtx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_ = server.Shutdown(shutdownCtx)
+
+		// Requests are over, the connections pooled to sites are of no use.
+		ctx.resolver.CloseIdleConnections()
+	}()
+
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	<-snapshotDone
+
+	return nil
+}
+
+// commands are the admin jobs run instead of the server, with the environment
+// of the server.
+var commands = map[string]func(args []string) error{
+	"prewarm":   runPrewarm,
+	"inventory": runInventory,
+	"gc":        runGC,
 }
 
 func main() {
@@ -278,9 +376,24 @@ func main() {
 		defaults.CacheStatus = defaults.CacheDisabled
 	}
 
-	err := runHttpServer(":3333")
-	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Cannot start server: %s\n", err)
-		os.Exit(1)
+	switch command := flag.Arg(0); command {
+	case "":
+		err := runHttpServer(":3333")
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Cannot start server: %s\n", err)
+			os.Exit(1)
+		}
+	default:
+		run, ok := commands[command]
+		if !ok {
+			_, _ = fmt.Fprintf(os.Stderr, "Unknown command %q, expected prewarm, inventory or gc\n", command)
+			os.Exit(2)
+		}
+
+		err := run(flag.Args()[1:])
+		if err != nil && !errors.Is(err, flag.ErrHelp) {
+			_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"faviconapi/favicon"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "faviconapi_requests_total",
+		Help: "Requests served, by endpoint and status code.",
+	}, []string{"endpoint", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "faviconapi_request_duration_seconds",
+		Help:    "Time taken to answer requests, by endpoint.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"endpoint"})
+
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "faviconapi_cache_lookups_total",
+		Help: "Stored icon lookups, by the layer that answered: memory, storage or miss.",
+	}, []string{"layer"})
+
+	resolutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "faviconapi_resolutions_total",
+		Help: "Icon resolutions against upstream sites, by outcome.",
+	}, []string{"outcome"})
+
+	upstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "faviconapi_upstream_request_duration_seconds",
+		Help:    "Time until response headers for outbound requests, by status code (error when none came back).",
+		Buckets: []float64{.025, .05, .1, .25, .5, 1, 2, 5, 10},
+	}, []string{"status"})
+
+	limiterWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "faviconapi_limiter_wait_seconds",
+		Help:    "Time spent waiting on the outbound rate limiter.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+	})
+
+	uploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "faviconapi_uploaded_bytes_total",
+		Help: "Bytes of icons uploaded to storage.",
+	})
+)
+
+// resolutionOutcome names the outcome of FindFaviconURL for the resolutions metric.
+func resolutionOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "found"
+	case errors.Is(err, favicon.ErrDecodeFailed):
+		return "decode_error"
+	case errors.Is(err, favicon.ErrIconNotFound):
+		return "not_found"
+	case errors.Is(err, favicon.ErrIconTooLarge):
+		return "too_large"
+	case errors.Is(err, favicon.ErrUpstreamRateLimited):
+		return "rate_limited"
+	case errors.Is(err, favicon.ErrUnreachableServer):
+		return "unreachable"
+	default:
+		return "error"
+	}
+}
+
+// instrumentedTransport times outbound requests until their response headers.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	upstreamDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+
+	return res, err
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"faviconapi/favicon"
+	"faviconapi/iconpatch"
+	"flag"
+	"fmt"
+	"golang.org/x/net/publicsuffix"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// runPrewarm resolves and stores the icons of a list of domains ahead of their
+// first request, so that onboarding a large customer does not send every one
+// of them through a cold resolution at once.
+//
+//	faviconapi prewarm [-concurrency 8] [-checkpoint prewarm.ckpt] [domains.txt]
+//
+// Domains are read one per line from the file, or from stdin when there is
+// none. Domains recorded in the checkpoint file are skipped, so an interrupted
+// run can be started again with the same arguments.
+func runPrewarm(args []string) error {
+	fs := flag.NewFlagSet("prewarm", flag.ContinueOnError)
+	concurrency := fs.Int("concurrency", 8, "number of domains resolved at the same time")
+	hostDelay := fs.Duration("host-delay", time.Second, "minimum delay between two resolutions on the same site")
+	checkpointPath := fs.String("checkpoint", "", "file recording the domains done, read back to resume")
+	transform := fs.String("transform", "", "transform pipeline of the stored icons")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *concurrency < 1 {
+		return errors.New("concurrency must be at least 1")
+	}
+
+	pipeline, err := iconpatch.ParsePipeline(*transform)
+	if err != nil {
+		return err
+	}
+
+	domains, err := readDomains(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	ctx, err := newContext()
+	if err != nil {
+		return err
+	}
+
+	checkpoint, done, err := openCheckpoint(*checkpointPath)
+	if err != nil {
+		return err
+	}
+
+	// Stop handing out domains on interrupt, the ones in flight are finished so
+	// that the checkpoint stays accurate.
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report := &prewarmReport{started: time.Now(), failures: map[ErrorCode]int{}}
+	gate := &hostGate{delay: *hostDelay, sites: map[string]*siteSlot{}}
+
+	queue := make(chan string)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for domain := range queue {
+				outcome := prewarmDomain(ctx, gate, pipeline, domain)
+				report.add(outcome)
+
+				// Failures are left out of the checkpoint, a resumed run retries them.
+				if outcome == "found" || outcome == string(CodeIconNotFound) {
+					checkpoint.record(domain, outcome)
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, domain := range domains {
+		if done[domain] {
+			report.skipped++
+			continue
+		}
+
+		select {
+		case queue <- domain:
+		case <-signalCtx.Done():
+			report.interrupted = true
+			break dispatch
+		}
+	}
+
+	close(queue)
+	wg.Wait()
+	ctx.resolver.CloseIdleConnections()
+
+	report.print(os.Stdout)
+
+	return checkpoint.Close()
+}
+
+// prewarmDomain resolves domain through the same path as the resolve endpoint
+// and returns "found", the error code of the failure otherwise.
+func prewarmDomain(ctx Context, gate *hostGate, pipeline iconpatch.Pipeline, domain string) string {
+	target, err := url.ParseRequestURI("https://" + domain)
+	if err != nil || target.Hostname() == "" {
+		return string(CodeInvalidURL)
+	}
+
+	release := gate.acquire(target.Hostname())
+	defer release()
+
+	ctx.requestID = "prewarm"
+	ctx.log = ctx.log.With().Str("domain", domain).Logger()
+
+	// Prewarmed icons are not accessed yet, they are unused until requested.
+	_, err = resolveIcon(ctx, ResolveRequest{URL: target, Pipeline: pipeline, Animation: favicon.AnimationFirst, SkipAccess: true})
+	if err != nil {
+		code := classifyError(err)
+		if code != CodeIconNotFound {
+			ctx.log.Warn().Err(err).Str("code", string(code)).Msg("prewarm failed")
+		}
+
+		return string(code)
+	}
+
+	return "found"
+}
+
+// readDomains reads one domain per line, ignoring blank lines, comments and
+// duplicates. Full URLs are reduced to their host.
+func readDomains(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	seen := map[string]bool{}
+	var domains []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		domain := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if domain == "" || strings.HasPrefix(domain, "#") {
+			continue
+		}
+
+		if u, err := url.Parse(domain); err == nil && u.Host != "" {
+			domain = u.Host
+		}
+
+		if !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains, scanner.Err()
+}
+
+// prewarmCheckpoint appends "domain<TAB>outcome" lines as domains complete.
+// A nil checkpoint records nothing.
+type prewarmCheckpoint struct {
+	mu   sync.Mutex
+	file *os.File
+	err  error
+}
+
+// openCheckpoint opens the checkpoint at path for appending and returns the
+// domains it already lists. An empty path disables checkpointing.
+func openCheckpoint(path string) (*prewarmCheckpoint, map[string]bool, error) {
+	done := map[string]bool{}
+	if path == "" {
+		return nil, done, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		domain, _, _ := strings.Cut(scanner.Text(), "\t")
+		if domain != "" {
+			done[domain] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+
+	return &prewarmCheckpoint{file: file}, done, nil
+}
+
+func (c *prewarmCheckpoint) record(domain, outcome string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(c.file, "%s\t%s\n", domain, outcome); err != nil && c.err == nil {
+		c.err = fmt.Errorf("checkpoint: %w", err)
+	}
+}
+
+// Close also reports the first error met while recording.
+func (c *prewarmCheckpoint) Close() error {
+	if c == nil {
+		return nil
+	}
+
+	err := c.file.Close()
+	if c.err != nil {
+		return c.err
+	}
+
+	return err
+}
+
+// hostGate is the per-site politeness rule of the prewarm: a site, as in its
+// registrable domain, is resolved once at a time and at least delay apart, on
+// top of the global rate limit every resolution goes through.
+type hostGate struct {
+	mu    sync.Mutex
+	delay time.Duration
+	sites map[string]*siteSlot
+}
+
+type siteSlot struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+// acquire waits for the turn of the site of host, the returned function must
+// be called once its resolution is over.
+func (g *hostGate) acquire(host string) func() {
+	site, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		site = host
+	}
+
+	g.mu.Lock()
+	slot, ok := g.sites[site]
+	if !ok {
+		slot = &siteSlot{}
+		g.sites[site] = slot
+	}
+	g.mu.Unlock()
+
+	slot.mu.Lock()
+	if wait := time.Until(slot.last.Add(g.delay)); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return func() {
+		slot.last = time.Now()
+		slot.mu.Unlock()
+	}
+}
+
+type prewarmReport struct {
+	mu          sync.Mutex
+	started     time.Time
+	found       int
+	notFound    int
+	skipped     int
+	failures    map[ErrorCode]int
+	interrupted bool
+}
+
+func (r *prewarmReport) add(outcome string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch outcome {
+	case "found":
+		r.found++
+	case string(CodeIconNotFound):
+		r.notFound++
+	default:
+		r.failures[ErrorCode(outcome)]++
+	}
+}
+
+func (r *prewarmReport) print(w io.Writer) {
+	failed := 0
+	codes := make([]string, 0, len(r.failures))
+	for code, n := range r.failures {
+		failed += n
+		codes = append(codes, string(code))
+	}
+	sort.Strings(codes)
+
+	if r.interrupted {
+		fmt.Fprintln(w, "interrupted, run again with the same checkpoint to resume")
+	}
+
+	fmt.Fprintf(w, "found:     %d\n", r.found)
+	fmt.Fprintf(w, "not found: %d\n", r.notFound)
+	fmt.Fprintf(w, "failed:    %d\n", failed)
+	for _, code := range codes {
+		fmt.Fprintf(w, "  %-22s %d\n", code, r.failures[ErrorCode(code)])
+	}
+	fmt.Fprintf(w, "skipped:   %d (already in the checkpoint)\n", r.skipped)
+	fmt.Fprintf(w, "elapsed:   %s\n", time.Since(r.started).Round(time.Second))
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"faviconapi/avatar"
+	"faviconapi/defaults"
+	"faviconapi/favicon"
+	"faviconapi/iconpatch"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"image"
+	"image/color"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ResolveRequest struct {
+	URL       *url.URL
+	Pipeline  iconpatch.Pipeline
+	Animation favicon.AnimationPolicy
+	// Theme is "dark" to get the variant adapted to Background.
+	Theme      string
+	Background color.NRGBA
+	// Avatar asks for a generated letter avatar when the site has no icon.
+	Avatar bool
+	// SkipAccess leaves the last access of the host as it is, for resolutions
+	// no client asked for, so that gc -unused-days still sees them unused.
+	SkipAccess bool
+}
+
+// parseResolveRequest reads the site URL following prefix in the path of r, and
+// the query parameters shared by every version of the resolve endpoint.
+func parseResolveRequest(r *http.Request, prefix string) (ResolveRequest, error) {
+	target, err := parseTargetURL(r, prefix)
+	if err != nil {
+		return ResolveRequest{}, err
+	}
+
+	query := r.URL.Query()
+
+	req := ResolveRequest{
+		URL:        target,
+		Theme:      strings.ToLower(strings.TrimSpace(query.Get("theme"))),
+		Background: iconpatch.DarkBackground,
+	}
+
+	req.Pipeline, err = iconpatch.ParsePipeline(query.Get("transform"))
+	if err != nil {
+		return req, &ParameterError{Message: err.Error()}
+	}
+
+	req.Animation, err = favicon.ParseAnimationPolicy(query.Get("animation"))
+	if err != nil {
+		return req, &ParameterError{Message: err.Error()}
+	}
+
+	if req.Theme != "" && req.Theme != "light" && req.Theme != "dark" {
+		return req, &ParameterError{Message: "theme must be light or dark"}
+	}
+
+	switch query.Get("fallback") {
+	case "":
+	case "avatar":
+		req.Avatar = true
+	default:
+		return req, &ParameterError{Message: "fallback must be avatar"}
+	}
+
+	if v := query.Get("background"); v != "" {
+		req.Background, err = iconpatch.ParseHexColor(v)
+		if err != nil {
+			return req, &ParameterError{Message: "background " + err.Error()}
+		}
+	}
+
+	return req, nil
+}
+
+type ResolveResult struct {
+	URL  string
+	Meta map[string]string
+}
+
+// resolveIcon returns the stored icon matching req, resolving, processing and
+// storing it when there is none yet. Errors wrapping ErrIconNotFound mean
+// that the site has no usable icon.
+func resolveIcon(ctx Context, req ResolveRequest) (*ResolveResult, error) {
+	host := req.URL.Hostname()
+
+	if !req.SkipAccess {
+		recordAccess(ctx, host)
+	}
+
+	if defaults.CacheStatus == defaults.CacheEnabled {
+		// The format of the icon is not known before resolving it, every one
+		// it may be stored in is looked up.
+		for _, format := range iconFormats(req.Animation) {
+			lookupKey := iconObjectKey(host, req.Pipeline, req.Animation, format)
+			if req.Theme == "dark" {
+				lookupKey = darkObjectKey(lookupKey, req.Background)
+			}
+
+			// First layer is the memory cache, second layer a lookup to see if
+			// there's an object with the future name of the icon.
+			meta, ok, err := cachedIcon(ctx, lookupKey)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok {
+				return &ResolveResult{URL: iconURL(meta), Meta: meta}, nil
+			}
+		}
+
+		// Missing or made by an older version, keep going
+	}
+
+	waitStart := time.Now()
+	ctx.limiter.Take()
+	limiterWait.Observe(time.Since(waitStart).Seconds())
+
+	resolvedIcon, err := ctx.resolver.FindFaviconURL(ctx.requestContext(), req.URL)
+	resolutions.WithLabelValues(resolutionOutcome(err)).Inc()
+	if err != nil {
+		logRejection(ctx, req.URL, err)
+
+		if req.Avatar && errors.Is(err, favicon.ErrIconNotFound) {
+			return resolveAvatar(ctx, req.URL.Hostname())
+		}
+
+		return nil, err
+	}
+
+	_, span := tracer.Start(ctx.requestContext(), "patch icon", trace.WithAttributes(attribute.String("transform", req.Pipeline.String())))
+	patched, err := favicon.PatchIcon(resolvedIcon, req.Pipeline, req.Animation)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	iconMetadata := iconMeta(req, resolvedIcon, patched)
+
+	objectKey := iconObjectKey(host, req.Pipeline, req.Animation, patched.Format())
+
+	err = storeIcon(ctx, host, objectKey, patched, iconMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Theme != "dark" {
+		return &ResolveResult{URL: iconURL(iconMetadata), Meta: iconMetadata}, nil
+	}
+
+	// The dark variant is stored alongside the light one, which we just made
+	// anyway. Animations get the adjustment of their first frame throughout.
+	adjustment := iconpatch.ChooseAdjustment(patched.Image, req.Background)
+	dark := patched.Map(func(img image.Image) *image.NRGBA {
+		return iconpatch.ApplyAdjustment(img, adjustment)
+	})
+
+	darkMetadata := make(map[string]string, len(iconMetadata)+2)
+	for k, v := range iconMetadata {
+		darkMetadata[k] = v
+	}
+	darkMetadata["theme"] = "dark"
+	darkMetadata["adjustment"] = string(adjustment)
+
+	darkKey := darkObjectKey(objectKey, req.Background)
+
+	err = storeIcon(ctx, host, darkKey, dark, darkMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResolveResult{URL: iconURL(darkMetadata), Meta: darkMetadata}, nil
+}
+
+// resolveAvatar returns the letter avatar of host, generating and storing it
+// when there is none yet. Transforms and themes do not apply to avatars.
+func resolveAvatar(ctx Context, host string) (*ResolveResult, error) {
+	key := avatarObjectKey(host)
+
+	if defaults.CacheStatus == defaults.CacheEnabled {
+		meta, ok, err := cachedIcon(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return &ResolveResult{URL: iconURL(meta), Meta: meta}, nil
+		}
+	}
+
+	img, initials, bg, err := avatar.Generate(host)
+	if err != nil {
+		return nil, err
+	}
+
+	patched := &favicon.PatchedIcon{Result: &iconpatch.Result{
+		Image:    img,
+		Filled:   true,
+		Analysis: iconpatch.Analyze(img),
+	}}
+
+	// S3 metadata is ASCII only, the initials of IDN hosts are percent-encoded.
+	meta := map[string]string{
+		"version":   Version,
+		"generated": "yes",
+		"initials":  url.PathEscape(initials),
+		"width":     strconv.Itoa(avatar.Size),
+		"height":    strconv.Itoa(avatar.Size),
+		"format":    patched.Format(),
+		"fetchedat": time.Now().UTC().Format(time.RFC3339),
+		"filled":    "yes",
+		"animated":  "no",
+		"dominant":  iconpatch.HexColor(bg),
+	}
+
+	err = storeIcon(ctx, host, key, patched, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ResolveResult{URL: iconURL(meta), Meta: meta}, nil
+}
+
+// iconMeta builds the metadata stored along with an icon. Keys are lowercase,
+// the way S3 returns them whatever case they were written in.
+func iconMeta(req ResolveRequest, resolvedIcon *favicon.ResolvedIcon, patched *favicon.PatchedIcon) map[string]string {
+	bounds := patched.Image.Bounds()
+	iconMetadata := map[string]string{
+		"version":   Version,
+		"transform": req.Pipeline.String(),
+		"width":     strconv.Itoa(bounds.Dx()),
+		"height":    strconv.Itoa(bounds.Dy()),
+		"format":    patched.Format(),
+		"fetchedat": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	// S3 caps user metadata at 2KB, overly long source URLs are left out.
+	if len(resolvedIcon.URL) <= 512 {
+		iconMetadata["source"] = resolvedIcon.URL
+	}
+
+	for k, v := range patched.Meta {
+		iconMetadata[k] = v
+	}
+
+	if patched.Filled {
+		iconMetadata["filled"] = "yes"
+	} else {
+		iconMetadata["filled"] = "no"
+	}
+
+	if resolvedIcon.Animation != nil {
+		iconMetadata["animated"] = "yes"
+		iconMetadata["frames"] = strconv.Itoa(len(resolvedIcon.Animation.Frames))
+		iconMetadata["animation"] = string(req.Animation)
+	} else {
+		iconMetadata["animated"] = "no"
+	}
+
+	if resolvedIcon.ColorProfile != "" {
+		iconMetadata["colorprofile"] = resolvedIcon.ColorProfile
+	}
+
+	if len(patched.Analysis.Palette) > 0 {
+		palette := make([]string, len(patched.Analysis.Palette))
+		for i, c := range patched.Analysis.Palette {
+			palette[i] = iconpatch.HexColor(c)
+		}
+
+		iconMetadata["dominant"] = iconpatch.HexColor(patched.Analysis.Dominant)
+		iconMetadata["palette"] = strings.Join(palette, ",")
+		iconMetadata["luminance"] = strconv.FormatFloat(patched.Analysis.Luminance, 'f', 3, 64)
+	}
+
+	// S3 caps user metadata at 2KB, overly long chains are left out.
+	if chain := strings.Join(resolvedIcon.Redirects, " "); len(resolvedIcon.Redirects) > 1 && len(chain) <= 1024 {
+		iconMetadata["redirects"] = chain
+	}
+
+	return iconMetadata
+}
+
+func logRejection(ctx Context, URL *url.URL, err error) {
+	var sniffErr *favicon.SniffError
+	if errors.As(err, &sniffErr) {
+		ctx.log.Info().Str("url", URL.String()).
+			Str("reason", sniffErr.Reason).
+			Str("contentType", sniffErr.ContentType).
+			Hex("head", sniffErr.Head[:min(len(sniffErr.Head), 16)]).
+			Msg("icon rejected")
+	}
+
+	var placeholderErr *favicon.PlaceholderError
+	if errors.As(err, &placeholderErr) {
+		ctx.log.Info().Str("url", URL.String()).
+			Str("placeholder", placeholderErr.Name).
+			Stringer("phash", placeholderErr.Hash).
+			Msg("icon rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"faviconapi/favicon"
+	"faviconapi/iconpatch"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxSharingHosts bounds the hosts listed by GetSharedIconEndpoint.
+const maxSharingHosts = 1000
+
+type SharedIcon struct {
+	SHA256    string   `json:"sha256"`
+	URL       string   `json:"url"`
+	Hosts     []string `json:"hosts"`
+	Truncated bool     `json:"truncated"`
+}
+
+// GetSharedIconEndpoint lists the hosts sharing an icon, given either the
+// sha256 of the icon or a host whose default icon is looked up.
+func GetSharedIconEndpoint(ctx Context, rw http.ResponseWriter, r *http.Request) HttpResponse {
+	arg, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v1/shared/"))
+	if err != nil || arg == "" || strings.Contains(arg, "/") {
+		return invalidParameter("expected a sha256 or a host")
+	}
+
+	arg = strings.ToLower(arg)
+
+	digest := arg
+	blob := ""
+
+	if _, err := hex.DecodeString(arg); err != nil || len(arg) != 64 {
+		meta, ok, err := cachedIcon(ctx, iconObjectKey(arg, iconpatch.DefaultPipeline, favicon.AnimationFirst, "png"))
+		if err != nil {
+			return errorResponse(ctx, err)
+		}
+
+		if !ok || meta["sha256"] == "" {
+			return HttpResponse{Status: http.StatusNotFound, Value: "no icon stored for " + arg, Error: CodeIconNotFound}
+		}
+
+		digest = meta["sha256"]
+		blob = meta["blob"]
+	}
+
+	hosts, truncated, err := sharingHosts(ctx, digest, maxSharingHosts)
+	if err != nil {
+		return errorResponse(ctx, err)
+	}
+
+	if len(hosts) == 0 {
+		return HttpResponse{Status: http.StatusNotFound, Value: "no host uses this icon", Error: CodeIconNotFound}
+	}
+
+	if blob == "" {
+		blob, err = findBlob(ctx, digest)
+		if err != nil {
+			return errorResponse(ctx, err)
+		}
+	}
+
+	shared := SharedIcon{SHA256: digest, Hosts: hosts, Truncated: truncated}
+	if blob != "" {
+		shared.URL = objectURL(blob)
+	}
+
+	return HttpResponse{Success: true, Value: shared}
+}
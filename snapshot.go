@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/patrickmn/go-cache"
+	"github.com/rs/zerolog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func init() {
+	// Icon metadata, the other cached values are booleans.
+	gob.Register(map[string]string{})
+}
+
+// cacheSnapshot is the memory cache as written to CACHE_SNAPSHOT_FILE, so that
+// a restarted instance does not go back to storage for every icon.
+type cacheSnapshot struct {
+	Version string
+	Items   map[string]cache.Item
+}
+
+// keepCachedEntry tells which snapshot entries are still valid: icon metadata
+// made by this Version, and the version independent access markers.
+func keepCachedEntry(key string) bool {
+	return strings.HasPrefix(key, Version+"|") || strings.HasPrefix(key, "access|")
+}
+
+// saveCacheSnapshot writes the unexpired entries of c to path, through a
+// temporary file so that a crash never leaves a truncated snapshot behind.
+func saveCacheSnapshot(c *cache.Cache, path string) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	err = gob.NewEncoder(tmp).Encode(cacheSnapshot{Version: Version, Items: c.Items()})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadCacheSnapshot adds the entries saved at path to c, keeping their
+// expiration. A missing snapshot is not an error.
+func loadCacheSnapshot(c *cache.Cache, path string) (restored int, discarded int, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var snapshot cacheSnapshot
+	err = gob.NewDecoder(f).Decode(&snapshot)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	now := time.Now()
+	for key, item := range snapshot.Items {
+		if !keepCachedEntry(key) {
+			discarded++
+			continue
+		}
+
+		expiration := cache.NoExpiration
+		if item.Expiration > 0 {
+			expiration = time.Unix(0, item.Expiration).Sub(now)
+			if expiration <= 0 {
+				continue
+			}
+		}
+
+		c.Set(key, item.Object, expiration)
+		restored++
+	}
+
+	return restored, discarded, nil
+}
+
+// snapshotCache saves c to path every interval, and a last time when ctx is done.
+func snapshotCache(ctx context.Context, c *cache.Cache, path string, interval time.Duration, log zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if err := saveCacheSnapshot(c, path); err != nil {
+				log.Error().Err(err).Msg("cannot save cache snapshot")
+			}
+
+			return
+		}
+
+		if err := saveCacheSnapshot(c, path); err != nil {
+			log.Error().Err(err).Msg("cannot save cache snapshot")
+		}
+	}
+}
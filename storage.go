@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"faviconapi/defaults"
+	"faviconapi/favicon"
+	"faviconapi/iconhash"
+	"faviconapi/iconpatch"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/patrickmn/go-cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"image/color"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// iconObjectKey names the host entry of the icon of host once processed by
+// pipeline and encoded in format. Other variants than the default one get
+// their own entry, named after a digest of their canonical form to keep keys
+// short.
+func iconObjectKey(host string, pipeline iconpatch.Pipeline, policy favicon.AnimationPolicy, format string) string {
+	if pipeline.IsDefault() && policy == favicon.AnimationFirst {
+		return "entries/" + host + "." + format
+	}
+
+	variant := pipeline.String()
+	if policy != favicon.AnimationFirst {
+		variant += "|animation=" + string(policy)
+	}
+
+	digest := sha256.Sum256([]byte(variant))
+
+	return "entries/" + host + "." + hex.EncodeToString(digest[:6]) + "." + format
+}
+
+// storedFormats lists the formats icons are stored in, see PatchedIcon.Format.
+var storedFormats = []string{"png", "gif", "webp"}
+
+// iconFormats returns the formats the icon stored for policy may be in. Only
+// preserved animations are stored in another format than PNG.
+func iconFormats(policy favicon.AnimationPolicy) []string {
+	if policy == favicon.AnimationPreserve {
+		return storedFormats
+	}
+
+	return []string{"png"}
+}
+
+// avatarObjectKey names the host entry of the letter avatar generated for host.
+func avatarObjectKey(host string) string {
+	return "entries/" + host + ".avatar.png"
+}
+
+// darkObjectKey names the dark variant stored alongside the icon at key.
+func darkObjectKey(key string, background color.NRGBA) string {
+	ext := path.Ext(key)
+
+	suffix := ".dark" + ext
+	if background != iconpatch.DarkBackground {
+		suffix = ".dark-" + hex.EncodeToString([]byte{background.R, background.G, background.B}) + ext
+	}
+
+	return strings.TrimSuffix(key, ext) + suffix
+}
+
+func objectURL(key string) string {
+	return "https://" + cdnHostForBucket + "/" + key
+}
+
+// iconURL returns the public URL of the icon a host entry points at.
+func iconURL(meta map[string]string) string {
+	return objectURL(meta["blob"])
+}
+
+func iconCacheKey(key string) string {
+	return Version + "|" + key
+}
+
+// cachedIcon returns the metadata of the icon stored at key, looking in the
+// memory cache first.
+func cachedIcon(ctx Context, key string) (map[string]string, bool, error) {
+	if meta, ok := ctx.cache.Get(iconCacheKey(key)); ok {
+		cacheLookups.WithLabelValues("memory").Inc()
+		return meta.(map[string]string), true, nil
+	}
+
+	meta, ok, err := headIcon(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !ok {
+		cacheLookups.WithLabelValues("miss").Inc()
+		return nil, false, nil
+	}
+
+	cacheLookups.WithLabelValues("storage").Inc()
+
+	ctx.cache.Set(iconCacheKey(key), meta, cache.DefaultExpiration)
+
+	return meta, true, nil
+}
+
+// ErrStorage wraps the errors of the object storage.
+var ErrStorage = errors.New("storage error")
+
+func storageError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %w", ErrStorage, err)
+}
+
+func isNotFound(err error) bool {
+	var responseError *awshttp.ResponseError
+	return errors.As(err, &responseError) && responseError.ResponseError.HTTPStatusCode() == http.StatusNotFound
+}
+
+// headIcon returns the metadata of the icon stored at key, if there is one
+// that was made by this Version.
+func headIcon(ctx Context, key string) (map[string]string, bool, error) {
+	spanCtx, span := tracer.Start(ctx.requestContext(), "s3.HeadObject", trace.WithAttributes(attribute.String("key", key)))
+	head, err := ctx.s3.HeadObject(spanCtx, &s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+	})
+	span.End()
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, storageError(err)
+	}
+
+	if head.Metadata["version"] != Version {
+		return nil, false, nil
+	}
+
+	return head.Metadata, true, nil
+}
+
+// blobKey names the content-addressed object holding an encoded icon.
+func blobKey(digest string, contentType string) string {
+	return "blobs/" + digest + "." + strings.TrimPrefix(contentType, "image/")
+}
+
+// indexKey names the empty object recording that host uses the blob with digest,
+// listing index/<digest>/ gives every host sharing an icon.
+func indexKey(digest string, host string) string {
+	return "index/" + digest + "/" + host
+}
+
+// storeIcon uploads icon once per distinct content under blobs/, then writes
+// the host entry at key pointing to it. The entry is an empty, private object
+// carrying the metadata: icons are only ever served from blobs/. Entries made
+// before that hold the icon under favicons/, they are left there for the URLs
+// handed out already. The content and perceptual hashes, and host, are added
+// to meta.
+func storeIcon(ctx Context, host string, key string, icon *favicon.PatchedIcon, meta map[string]string) (err error) {
+	data, contentType, err := icon.Encode()
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	blob := blobKey(digest, contentType)
+
+	meta["sha256"] = digest
+	meta["phash"] = iconhash.DHash(icon.Image).String()
+	meta["blob"] = blob
+	meta["host"] = host
+
+	err = putBlob(ctx, blob, data, contentType, meta)
+	if err != nil {
+		return err
+	}
+
+	spanCtx, span := tracer.Start(ctx.requestContext(), "s3.PutObject", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	// The digest of the icon being replaced, whose index object goes away.
+	var previous string
+	head, err := ctx.s3.HeadObject(spanCtx, &s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+	})
+	switch {
+	case err == nil:
+		previous = head.Metadata["sha256"]
+	case !isNotFound(err):
+		return storageError(err)
+	}
+
+	_, err = ctx.s3.PutObject(spanCtx, &s3.PutObjectInput{
+		Bucket:   &s3Bucket,
+		Key:      &key,
+		Body:     bytes.NewReader(nil),
+		Metadata: meta,
+	})
+	if err != nil {
+		return storageError(err)
+	}
+
+	_, err = ctx.s3.PutObject(spanCtx, &s3.PutObjectInput{
+		Bucket: &s3Bucket,
+		Key:    aws.String(indexKey(digest, host)),
+		Body:   bytes.NewReader(nil),
+	})
+	if err != nil {
+		return storageError(err)
+	}
+
+	// Another variant of host may still use the previous icon, it is then
+	// listed again when that variant is next stored.
+	if previous != "" && previous != digest {
+		_, err = ctx.s3.DeleteObject(spanCtx, &s3.DeleteObjectInput{
+			Bucket: &s3Bucket,
+			Key:    aws.String(indexKey(previous, host)),
+		})
+		if err != nil {
+			return storageError(err)
+		}
+	}
+
+	if defaults.CacheStatus == defaults.CacheEnabled {
+		ctx.cache.Set(iconCacheKey(key), meta, cache.DefaultExpiration)
+	}
+
+	return nil
+}
+
+// putBlob uploads data at key unless it is there already. Whether it is there
+// is asked to storage every time rather than remembered, the gc command deletes
+// the blobs no entry refers to.
+func putBlob(ctx Context, key string, data []byte, contentType string, meta map[string]string) (err error) {
+	spanCtx, span := tracer.Start(ctx.requestContext(), "s3.PutObject blob", trace.WithAttributes(attribute.String("key", key)))
+	defer func() { endSpan(span, err) }()
+
+	_, err = ctx.s3.HeadObject(spanCtx, &s3.HeadObjectInput{
+		Bucket: &s3Bucket,
+		Key:    &key,
+	})
+	if err == nil {
+		span.SetAttributes(attribute.Bool("deduplicated", true))
+		return nil
+	}
+
+	if !isNotFound(err) {
+		return storageError(err)
+	}
+
+	_, err = ctx.s3.PutObject(spanCtx, &s3.PutObjectInput{
+		Bucket:      &s3Bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType),
+		Metadata: map[string]string{
+			"sha256": meta["sha256"],
+			"phash":  meta["phash"],
+		},
+		// Content-addressed, the object at this key can be cached forever.
+		CacheControl: aws.String("public, max-age=31536000, immutable"),
+		ACL:          "public-read",
+	})
+	if err != nil {
+		return storageError(err)
+	}
+
+	uploadedBytes.Add(float64(len(data)))
+
+	return nil
+}
+
+// accessKey names the empty object whose modification time is the last time,
+// to within a day, the icon of host was requested.
+func accessKey(host string) string {
+	return "access/" + host
+}
+
+// accessInterval is how often an instance refreshes the access object of a host.
+const accessInterval = 24 * time.Hour
+
+// recordAccess refreshes the access object of host at most once per
+// accessInterval per instance, in the background since only the gc command
+// reads it.
+func recordAccess(ctx Context, host string) {
+	cacheKey := "access|" + host
+	if _, ok := ctx.cache.Get(cacheKey); ok {
+		return
+	}
+
+	ctx.cache.Set(cacheKey, true, accessInterval)
+
+	go func() {
+		_, err := ctx.s3.PutObject(context.WithoutCancel(ctx.requestContext()), &s3.PutObjectInput{
+			Bucket: &s3Bucket,
+			Key:    aws.String(accessKey(host)),
+			Body:   bytes.NewReader(nil),
+		})
+		if err != nil {
+			ctx.log.Warn().Err(err).Str("host", host).Msg("cannot record access")
+		}
+	}()
+}
+
+// findBlob returns the key of the blob with digest, empty when there is none.
+func findBlob(ctx Context, digest string) (string, error) {
+	for _, format := range storedFormats {
+		key := blobKey(digest, "image/"+format)
+
+		_, err := ctx.s3.HeadObject(ctx.requestContext(), &s3.HeadObjectInput{
+			Bucket: &s3Bucket,
+			Key:    &key,
+		})
+		if err == nil {
+			return key, nil
+		}
+
+		if !isNotFound(err) {
+			return "", storageError(err)
+		}
+	}
+
+	return "", nil
+}
+
+// sharingHosts lists the hosts whose icon is the blob with digest, at most limit
+// of them. truncated is set when there are more.
+func sharingHosts(ctx Context, digest string, limit int) (hosts []string, truncated bool, err error) {
+	prefix := "index/" + digest + "/"
+
+	paginator := s3.NewListObjectsV2Paginator(ctx.s3, &s3.ListObjectsV2Input{
+		Bucket: &s3Bucket,
+		Prefix: &prefix,
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx.requestContext())
+		if err != nil {
+			return nil, false, storageError(err)
+		}
+
+		for _, object := range page.Contents {
+			if len(hosts) == limit {
+				return hosts, true, nil
+			}
+
+			hosts = append(hosts, strings.TrimPrefix(aws.ToString(object.Key), prefix))
+		}
+	}
+
+	return hosts, false, nil
+}